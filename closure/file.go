@@ -1,20 +1,44 @@
 package closure
 
 import (
+	"bytes"
 	"encoding/json"
 	"os"
+	"sort"
 )
 
 type Storepath struct {
 	Path       string   `json:"path"`
 	References []string `json:"references"`
+	// The size of the NAR serialisation of the store path, in bytes
+	NarSize int64 `json:"narSize"`
 }
 
+// ReadClosureGraphFile reads a closure graph generated by
+// exportReferencesGraph or by `nix path-info --json`. The latter
+// can be a list of store paths or, on recent Nix versions, an object
+// whose keys are the store paths.
 func ReadClosureGraphFile(filename string) (storepaths []Storepath, err error) {
 	content, err := os.ReadFile(filename)
 	if err != nil {
 		return
 	}
+	if bytes.HasPrefix(bytes.TrimSpace(content), []byte("{")) {
+		var byPath map[string]Storepath
+		err = json.Unmarshal(content, &byPath)
+		if err != nil {
+			return storepaths, err
+		}
+		for path, storepath := range byPath {
+			storepath.Path = path
+			storepaths = append(storepaths, storepath)
+		}
+		// Map iteration order is random
+		sort.Slice(storepaths, func(i, j int) bool {
+			return storepaths[i].Path < storepaths[j].Path
+		})
+		return storepaths, nil
+	}
 	err = json.Unmarshal(content, &storepaths)
 	if err != nil {
 		return storepaths, err
@@ -1,6 +1,8 @@
 package closure
 
 import (
+	"os"
+	"reflect"
 	"testing"
 )
 
@@ -13,3 +15,32 @@ func TestReadClosureGraphFile(t *testing.T) {
 		t.Fatalf("The graph should contain %d nodes (actual %d)", 9, len(nodes))
 	}
 }
+
+func TestReadClosureGraphFileNarSize(t *testing.T) {
+	nodes, err := ReadClosureGraphFile("../data/closure-graph.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodes[0].NarSize != 206104 {
+		t.Fatalf("The narSize of %s should be %d (actual %d)", nodes[0].Path, 206104, nodes[0].NarSize)
+	}
+}
+
+func TestReadClosureGraphFilePathInfo(t *testing.T) {
+	filename := t.TempDir() + "/path-info.json"
+	content := `{"/nix/store/b-path": {"narSize": 2, "references": []}, "/nix/store/a-path": {"narSize": 1, "references": ["/nix/store/b-path"]}}`
+	if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	nodes, err := ReadClosureGraphFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Storepath{
+		{Path: "/nix/store/a-path", References: []string{"/nix/store/b-path"}, NarSize: 1},
+		{Path: "/nix/store/b-path", References: []string{}, NarSize: 2},
+	}
+	if !reflect.DeepEqual(nodes, expected) {
+		t.Fatalf("The graph should be %#v (actual %#v)", expected, nodes)
+	}
+}
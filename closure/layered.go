@@ -55,3 +55,22 @@ func SortedPathsByPopularity(storepaths []Storepath) ([]string, error) {
 	}
 	return out, nil
 }
+
+// PopularityByPath returns the popularity of each storepath, as
+// computed by SortedPathsByPopularity.
+func PopularityByPath(storepaths []Storepath) (map[string]int64, error) {
+	paths, g := buildGraph(storepaths)
+	scored, err := Score(g)
+	if err != nil {
+		return nil, err
+	}
+	scores := make(map[int64]int64, len(scored))
+	for _, s := range scored {
+		scores[s.id] = s.score
+	}
+	popularity := make(map[string]int64, len(paths))
+	for p, id := range paths {
+		popularity[p] = scores[id]
+	}
+	return popularity, nil
+}
@@ -55,3 +55,28 @@ func TestPopularities(t *testing.T) {
 		t.Fatalf("Popularity should be '%#v' (while it is %#v)", expected, popularity)
 	}
 }
+
+func TestPopularityByPath(t *testing.T) {
+	storepaths := []Storepath{
+		{
+			Path:       "A",
+			References: []string{"A", "B", "C"},
+		},
+		{
+			Path:       "B",
+			References: []string{"B", "C"},
+		},
+		{
+			Path:       "C",
+			References: []string{"C"},
+		},
+	}
+	popularity, err := PopularityByPath(storepaths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]int64{"A": 1, "B": 2, "C": 4}
+	if !reflect.DeepEqual(popularity, expected) {
+		t.Fatalf("Popularity should be '%#v' (while it is %#v)", expected, popularity)
+	}
+}
@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/nlewo/nix2container/nix"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var exportOCILayoutCmd = &cobra.Command{
+	Use:   "export-oci-layout OUTPUT-DIRECTORY IMAGE.JSON",
+	Short: "Write the image (or the image index) described by IMAGE.JSON to OUTPUT-DIRECTORY as an OCI image layout",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := exportOCILayout(args[0], args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func exportOCILayout(outputDirectory, imageFilename string) error {
+	isIndex, err := nix.IsImageIndexFile(imageFilename)
+	if err != nil {
+		return err
+	}
+	if isIndex {
+		index, err := nix.NewImageIndexFromFile(imageFilename)
+		if err != nil {
+			return err
+		}
+		err = nix.WriteOCILayoutImageIndex(index, outputDirectory)
+		if err != nil {
+			return err
+		}
+		logrus.Infof("Image index has been written to %s", outputDirectory)
+		return nil
+	}
+	image, err := nix.NewImageFromFile(imageFilename)
+	if err != nil {
+		return err
+	}
+	err = nix.WriteOCILayout(image, outputDirectory)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("Image has been written to %s", outputDirectory)
+	return nil
+}
+
+var dockerArchiveTag string
+
+var exportDockerArchiveCmd = &cobra.Command{
+	Use:   "export-docker-archive OUTPUT.TAR IMAGE.JSON",
+	Short: "Write the image described by IMAGE.JSON to OUTPUT.TAR as an archive loadable by 'docker load'. If OUTPUT.TAR is '-', the archive is written to stdout.",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := exportDockerArchive(args[0], args[1], dockerArchiveTag)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func exportDockerArchive(outputFilename, imageFilename, tag string) error {
+	isIndex, err := nix.IsImageIndexFile(imageFilename)
+	if err != nil {
+		return err
+	}
+	if isIndex {
+		return fmt.Errorf("%s describes an image index, which can not be exported as a docker archive", imageFilename)
+	}
+	image, err := nix.NewImageFromFile(imageFilename)
+	if err != nil {
+		return err
+	}
+	output := os.Stdout
+	if outputFilename != "-" {
+		output, err = os.Create(outputFilename)
+		if err != nil {
+			return err
+		}
+		defer output.Close() // nolint: errcheck
+	}
+	err = nix.WriteDockerArchive(image, output, tag)
+	if err != nil {
+		return err
+	}
+	if outputFilename != "-" {
+		if err := output.Close(); err != nil {
+			return err
+		}
+		logrus.Infof("Image has been written to %s", outputFilename)
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(exportOCILayoutCmd)
+	rootCmd.AddCommand(exportDockerArchiveCmd)
+	exportDockerArchiveCmd.Flags().StringVarP(&dockerArchiveTag, "tag", "", "", "The name and tag of the image in the archive, such as 'hello:latest'")
+}
@@ -17,6 +17,10 @@ import (
 var fromImageFilename string
 
 var imageArch string
+var imageVariant string
+var imageOSVersion string
+var imageOSFeatures []string
+var maxImageLayers int
 var created timeValue
 
 type timeValue time.Time
@@ -40,7 +44,15 @@ var imageCmd = &cobra.Command{
 	Short: "Generate an image.json file from a image configuration and layers",
 	Args:  cobra.MinimumNArgs(3),
 	Run: func(cmd *cobra.Command, args []string) {
-		err := image(args[0], args[1], fromImageFilename, args[2:], imageArch, (time.Time)(created))
+		arch, variant := nix.NormalizePlatform(imageArch, imageVariant)
+		platform := v1.Platform{
+			OS:           "linux",
+			Architecture: arch,
+			Variant:      variant,
+			OSVersion:    imageOSVersion,
+			OSFeatures:   imageOSFeatures,
+		}
+		err := image(args[0], args[1], fromImageFilename, args[2:], platform, (time.Time)(created), maxImageLayers)
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "%s", err)
 			os.Exit(1)
@@ -108,12 +120,17 @@ func imageFromManifest(outputFilename, manifestFilename string, blobsFilename st
 	return nil
 }
 
-func image(outputFilename, imageConfigPath string, fromImageFilename string, layerPaths []string, arch string, created time.Time) error {
+func image(outputFilename, imageConfigPath string, fromImageFilename string, layerPaths []string, platform v1.Platform, created time.Time, maxImageLayers int) error {
 	var imageConfig v1.ImageConfig
 	var image types.Image
 
 	image.Version = types.ImageVersion
 
+	err := nix.ValidatePlatform(platform)
+	if err != nil {
+		return err
+	}
+
 	logrus.Infof("Getting image configuration from %s", imageConfigPath)
 	imageConfigJson, err := os.ReadFile(imageConfigPath)
 	if err != nil {
@@ -134,7 +151,10 @@ func image(outputFilename, imageConfigPath string, fromImageFilename string, lay
 		logrus.Infof("Using base image %s containing %d layers", fromImageFilename, len(fromImage.Layers))
 	}
 
-	image.Arch = arch
+	image.Arch = platform.Architecture
+	image.Variant = platform.Variant
+	image.OSVersion = platform.OSVersion
+	image.OSFeatures = platform.OSFeatures
 
 	image.ImageConfig = imageConfig
 
@@ -166,6 +186,10 @@ func image(outputFilename, imageConfigPath string, fromImageFilename string, lay
 		}
 
 	}
+	image.Layers, err = nix.MergeLayers(image.Layers, maxImageLayers)
+	if err != nil {
+		return err
+	}
 	res, err := json.MarshalIndent(image, "", "\t")
 	if err != nil {
 		return err
@@ -182,6 +206,10 @@ func init() {
 	rootCmd.AddCommand(imageCmd)
 	imageCmd.Flags().StringVarP(&fromImageFilename, "from-image", "", "", "A JSON file describing the base image")
 	imageCmd.Flags().StringVarP(&imageArch, "arch", "", runtime.GOARCH, "Target CPU architecture of the image")
+	imageCmd.Flags().StringVarP(&imageVariant, "variant", "", "", "Target CPU variant of the image, such as v7 (or the GOARM value 7) for the arm architecture")
+	imageCmd.Flags().StringVarP(&imageOSVersion, "os-version", "", "", "Target OS version of the image")
+	imageCmd.Flags().StringSliceVarP(&imageOSFeatures, "os-features", "", nil, "Target OS features required by the image")
+	imageCmd.Flags().IntVarP(&maxImageLayers, "max-image-layers", "", nix.DefaultMaxImageLayers, "The maximum number of layers of the image: the least popular adjacent layers are merged to stay below this limit, 0 means unlimited")
 	imageCmd.Flags().Var(&created, "created", "Timestamp at which the image was created")
 	rootCmd.AddCommand(imageFromDirCmd)
 	rootCmd.AddCommand(imageFromManifestCmd)
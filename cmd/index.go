@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/nlewo/nix2container/nix"
+	"github.com/nlewo/nix2container/types"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var indexCmd = &cobra.Command{
+	Use:   "index OUTPUT-FILENAME IMAGE-1.JSON IMAGE-2.JSON ...",
+	Short: "Generate an index.json file describing a multi-architecture image from images built for different platforms",
+	Args:  cobra.MinimumNArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := index(args[0], args[1:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func index(outputFilename string, imageFilenames []string) error {
+	var images []types.Image
+	for _, filename := range imageFilenames {
+		image, err := nix.NewImageFromFile(filename)
+		if err != nil {
+			return err
+		}
+		logrus.Infof("Adding image %s (%s) to the index", filename, image.Arch)
+		images = append(images, image)
+	}
+	imageIndex, err := nix.NewImageIndex(images)
+	if err != nil {
+		return err
+	}
+	res, err := json.MarshalIndent(imageIndex, "", "\t")
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(outputFilename, []byte(res), 0666)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("Image index has been written to %s", outputFilename)
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(indexCmd)
+}
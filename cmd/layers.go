@@ -24,9 +24,22 @@ import (
 var ignore string
 var tarDirectory string
 var permsFilepath string
+var directoryPermsFilepath string
 var rewritesFilepath string
 var historyFilepath string
 var maxLayers int
+var maxLayerSize int64
+var compressionName string
+var strategyName string
+var groupsFilepath string
+var entriesFilepath string
+var deletionsFilepath string
+var hardLinks bool
+var digestCacheDirectory string
+var verifyCache bool
+var jobs int
+var layerPlanFilepath string
+var writeLayerPlanFilepath string
 
 // layerCmd represents the layer command
 var layersReproducibleCmd = &cobra.Command{
@@ -65,6 +78,46 @@ var layersReproducibleCmd = &cobra.Command{
 				os.Exit(1)
 			}
 		}
+		var layerGroups []types.LayerGroup
+		if groupsFilepath != "" {
+			layerGroups, err = readGroupsFile(groupsFilepath)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s", err)
+				os.Exit(1)
+			}
+		}
+		var directoryPerms []types.Perm
+		if directoryPermsFilepath != "" {
+			directoryPerms, err = readDirectoryPermsFile(directoryPermsFilepath)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s", err)
+				os.Exit(1)
+			}
+		}
+		var entries []types.Entry
+		if entriesFilepath != "" {
+			entries, err = readEntriesFile(entriesFilepath)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s", err)
+				os.Exit(1)
+			}
+		}
+		var deletions []types.Deletion
+		if deletionsFilepath != "" {
+			deletions, err = readDeletionsFile(deletionsFilepath)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s", err)
+				os.Exit(1)
+			}
+		}
+		var plan types.LayerPlan
+		if layerPlanFilepath != "" {
+			plan, err = readLayerPlanFile(layerPlanFilepath)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s", err)
+				os.Exit(1)
+			}
+		}
 		var history v1.History
 		if historyFilepath != "" {
 			history, err = readHistoryFile(historyFilepath)
@@ -74,7 +127,53 @@ var layersReproducibleCmd = &cobra.Command{
 			}
 		}
 
-		layers, err := nix.NewLayers(storepaths, maxLayers, parents, rewrites, ignore, perms, history)
+		compression, err := nix.ParseCompression(compressionName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			os.Exit(1)
+		}
+		strategy, err := nix.ParseLayeringStrategy(strategyName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			os.Exit(1)
+		}
+		infos, err := getPathInfos(closureGraph)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			os.Exit(1)
+		}
+		var cache *nix.DigestCache
+		if digestCacheDirectory != "" {
+			cache, err = nix.NewDigestCache(digestCacheDirectory, verifyCache)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s", err)
+				os.Exit(1)
+			}
+		} else if verifyCache {
+			fmt.Fprintf(os.Stderr, "--verify-cache requires --digest-cache")
+			os.Exit(1)
+		}
+
+		layers, plan, err := nix.NewLayers(storepaths, nix.LayerOptions{
+			LayerGroups:    layerGroups,
+			Strategy:       strategy,
+			MaxLayers:      maxLayers,
+			Infos:          infos,
+			Plan:           plan,
+			MaxLayerSize:   maxLayerSize,
+			Parents:        parents,
+			Rewrites:       rewrites,
+			Exclude:        ignore,
+			Perms:          perms,
+			Entries:        entries,
+			Deletions:      deletions,
+			DirectoryPerms: directoryPerms,
+			HardLinks:      hardLinks,
+			History:        history,
+			Compression:    compression,
+			Cache:          cache,
+			Jobs:           jobs,
+		})
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "%s", err)
 			os.Exit(1)
@@ -84,6 +183,13 @@ var layersReproducibleCmd = &cobra.Command{
 			fmt.Fprintf(os.Stderr, "%s", err)
 			os.Exit(1)
 		}
+		if writeLayerPlanFilepath != "" {
+			err = layerPlanToJson(writeLayerPlanFilepath, plan)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s", err)
+				os.Exit(1)
+			}
+		}
 	},
 }
 
@@ -124,6 +230,46 @@ var layersNonReproducibleCmd = &cobra.Command{
 				os.Exit(1)
 			}
 		}
+		var layerGroups []types.LayerGroup
+		if groupsFilepath != "" {
+			layerGroups, err = readGroupsFile(groupsFilepath)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s", err)
+				os.Exit(1)
+			}
+		}
+		var directoryPerms []types.Perm
+		if directoryPermsFilepath != "" {
+			directoryPerms, err = readDirectoryPermsFile(directoryPermsFilepath)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s", err)
+				os.Exit(1)
+			}
+		}
+		var entries []types.Entry
+		if entriesFilepath != "" {
+			entries, err = readEntriesFile(entriesFilepath)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s", err)
+				os.Exit(1)
+			}
+		}
+		var deletions []types.Deletion
+		if deletionsFilepath != "" {
+			deletions, err = readDeletionsFile(deletionsFilepath)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s", err)
+				os.Exit(1)
+			}
+		}
+		var plan types.LayerPlan
+		if layerPlanFilepath != "" {
+			plan, err = readLayerPlanFile(layerPlanFilepath)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s", err)
+				os.Exit(1)
+			}
+		}
 		var history v1.History
 		if historyFilepath != "" {
 			history, err = readHistoryFile(historyFilepath)
@@ -133,7 +279,41 @@ var layersNonReproducibleCmd = &cobra.Command{
 			}
 		}
 
-		layers, err := nix.NewLayersNonReproducible(storepaths, maxLayers, tarDirectory, parents, rewrites, ignore, perms, history)
+		compression, err := nix.ParseCompression(compressionName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			os.Exit(1)
+		}
+		strategy, err := nix.ParseLayeringStrategy(strategyName)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			os.Exit(1)
+		}
+		infos, err := getPathInfos(closureGraph)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			os.Exit(1)
+		}
+
+		layers, plan, err := nix.NewLayersNonReproducible(storepaths, tarDirectory, nix.LayerOptions{
+			LayerGroups:    layerGroups,
+			Strategy:       strategy,
+			MaxLayers:      maxLayers,
+			Infos:          infos,
+			Plan:           plan,
+			MaxLayerSize:   maxLayerSize,
+			Parents:        parents,
+			Rewrites:       rewrites,
+			Exclude:        ignore,
+			Perms:          perms,
+			Entries:        entries,
+			Deletions:      deletions,
+			DirectoryPerms: directoryPerms,
+			HardLinks:      hardLinks,
+			History:        history,
+			Compression:    compression,
+			Jobs:           jobs,
+		})
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "%s", err)
 			os.Exit(1)
@@ -143,6 +323,13 @@ var layersNonReproducibleCmd = &cobra.Command{
 			fmt.Fprintf(os.Stderr, "%s", err)
 			os.Exit(1)
 		}
+		if writeLayerPlanFilepath != "" {
+			err = layerPlanToJson(writeLayerPlanFilepath, plan)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s", err)
+				os.Exit(1)
+			}
+		}
 	},
 }
 
@@ -159,6 +346,36 @@ func layersToJson(outputFilename string, layers []types.Layer) error {
 	return nil
 }
 
+func layerPlanToJson(outputFilename string, plan types.LayerPlan) error {
+	res, err := json.MarshalIndent(plan, "", "\t")
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(outputFilename, res, 0666)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("The layer plan has been written to %s", outputFilename)
+	return nil
+}
+
+// getPathInfos returns the popularity and the size of the store
+// paths of the closure graph.
+func getPathInfos(closureGraph []closure.Storepath) (map[string]nix.PathInfo, error) {
+	popularity, err := closure.PopularityByPath(closureGraph)
+	if err != nil {
+		return nil, err
+	}
+	infos := make(map[string]nix.PathInfo, len(closureGraph))
+	for _, storepath := range closureGraph {
+		infos[storepath.Path] = nix.PathInfo{
+			Popularity: popularity[storepath.Path],
+			NarSize:    storepath.NarSize,
+		}
+	}
+	return infos, nil
+}
+
 func getLayersFromFiles(layersPaths []string) (layers []types.Layer, err error) {
 	for _, layersPath := range layersPaths {
 		ls, err := types.NewLayersFromFile(layersPath)
@@ -176,16 +393,40 @@ func init() {
 	// TODO: make this flag required
 	layersNonReproducibleCmd.Flags().StringVarP(&tarDirectory, "tar-directory", "", "", "The directory where tar of layers are created.")
 
-	layersNonReproducibleCmd.Flags().StringVarP(&rewritesFilepath, "rewrites", "", "", "A JSON file containing a list of path rewrites. Each element of the list is a JSON object with the attributes path, regex and repl: for a given path, the regex is replaced by repl.")
+	layersNonReproducibleCmd.Flags().StringVarP(&rewritesFilepath, "rewrites", "", "", "A JSON file containing a list of path rewrites. Each element of the list is a JSON object with the attributes path, regex and repl: for a given path, the regex is replaced by repl. The rewrites of a path are applied in order.")
 	layersNonReproducibleCmd.Flags().StringVarP(&permsFilepath, "perms", "", "", "A JSON file containing file permissions")
+	layersNonReproducibleCmd.Flags().StringVarP(&directoryPermsFilepath, "directory-perms", "", "", "A JSON file containing the permissions of the directories which are not in the Nix store, such as /nix/store: their regex is matched against the path of the directory in the layer")
+	layersNonReproducibleCmd.Flags().StringVarP(&groupsFilepath, "groups", "", "", "A JSON file containing named layer groups: store paths matching the regex of a group are put in the layer of this group")
+	layersNonReproducibleCmd.Flags().StringVarP(&layerPlanFilepath, "layer-plan", "", "", "A JSON layer plan written by a previous build with --write-layer-plan: its store paths keep their layer")
+	layersNonReproducibleCmd.Flags().StringVarP(&writeLayerPlanFilepath, "write-layer-plan", "", "", "Write the layer plan, mapping store path names to their layer, to this file")
+	layersNonReproducibleCmd.Flags().StringVarP(&entriesFilepath, "entries", "", "", "A JSON file containing the files, directories, symlinks and device nodes which are not in the Nix store created by the first layer")
+	layersNonReproducibleCmd.Flags().StringVarP(&deletionsFilepath, "deletions", "", "", "A JSON file containing the paths of lower layers deleted by the first layer")
+	layersNonReproducibleCmd.Flags().BoolVarP(&hardLinks, "hard-links", "", false, "Write files sharing their inode as hard links: the Nix store used to push the image must be optimised as the one used to build it")
 	layersNonReproducibleCmd.Flags().StringVarP(&historyFilepath, "history", "", "", "A JSON file containing layer history")
 	layersNonReproducibleCmd.Flags().IntVarP(&maxLayers, "max-layers", "", 1, "The maximum number of layers")
+	layersNonReproducibleCmd.Flags().Int64VarP(&maxLayerSize, "max-layer-size", "", 0, "The maximum size of a layer blob in bytes: bigger layers are split, 0 means unlimited")
+	layersNonReproducibleCmd.Flags().IntVarP(&jobs, "jobs", "", 1, "The maximum number of layers built concurrently, 0 means the number of CPUs")
+	layersNonReproducibleCmd.Flags().StringVarP(&strategyName, "strategy", "", "popularity", "The layering strategy: popularity isolates the most popular store paths, size creates layers of similar sizes by using the narSize of the closure graph")
+	layersNonReproducibleCmd.Flags().StringVarP(&compressionName, "compression", "", "none", "The compression of the layer tarballs written to the tar directory (none, gzip or zstd)")
 
 	rootCmd.AddCommand(layersReproducibleCmd)
 	layersReproducibleCmd.Flags().StringVarP(&ignore, "ignore", "", "", "Ignore the path from the list of storepaths")
 	layersReproducibleCmd.Flags().StringVarP(&rewritesFilepath, "rewrites", "", "", "A JSON file containing path rewrites")
 	layersReproducibleCmd.Flags().StringVarP(&permsFilepath, "perms", "", "", "A JSON file containing file permissions")
+	layersReproducibleCmd.Flags().StringVarP(&directoryPermsFilepath, "directory-perms", "", "", "A JSON file containing the permissions of the directories which are not in the Nix store, such as /nix/store: their regex is matched against the path of the directory in the layer")
+	layersReproducibleCmd.Flags().StringVarP(&groupsFilepath, "groups", "", "", "A JSON file containing named layer groups: store paths matching the regex of a group are put in the layer of this group")
+	layersReproducibleCmd.Flags().StringVarP(&layerPlanFilepath, "layer-plan", "", "", "A JSON layer plan written by a previous build with --write-layer-plan: its store paths keep their layer")
+	layersReproducibleCmd.Flags().StringVarP(&writeLayerPlanFilepath, "write-layer-plan", "", "", "Write the layer plan, mapping store path names to their layer, to this file")
+	layersReproducibleCmd.Flags().StringVarP(&entriesFilepath, "entries", "", "", "A JSON file containing the files, directories, symlinks and device nodes which are not in the Nix store created by the first layer")
+	layersReproducibleCmd.Flags().StringVarP(&deletionsFilepath, "deletions", "", "", "A JSON file containing the paths of lower layers deleted by the first layer")
+	layersReproducibleCmd.Flags().BoolVarP(&hardLinks, "hard-links", "", false, "Write files sharing their inode as hard links: the Nix store used to push the image must be optimised as the one used to build it")
+	layersReproducibleCmd.Flags().StringVarP(&digestCacheDirectory, "digest-cache", "", "", "A directory caching the digests of the layers, by store paths and options, to not read unchanged store paths again")
+	layersReproducibleCmd.Flags().BoolVarP(&verifyCache, "verify-cache", "", false, "Compute the digests of the layers cached in the --digest-cache directory again and fail if they differ")
 	layersReproducibleCmd.Flags().StringVarP(&historyFilepath, "history", "", "", "A JSON file containing layer history")
 	layersReproducibleCmd.Flags().IntVarP(&maxLayers, "max-layers", "", 1, "The maximum number of layers")
+	layersReproducibleCmd.Flags().Int64VarP(&maxLayerSize, "max-layer-size", "", 0, "The maximum size of a layer blob in bytes: bigger layers are split, 0 means unlimited")
+	layersReproducibleCmd.Flags().IntVarP(&jobs, "jobs", "", 1, "The maximum number of layers built concurrently, 0 means the number of CPUs")
+	layersReproducibleCmd.Flags().StringVarP(&strategyName, "strategy", "", "popularity", "The layering strategy: popularity isolates the most popular store paths, size creates layers of similar sizes by using the narSize of the closure graph")
+	layersReproducibleCmd.Flags().StringVarP(&compressionName, "compression", "", "none", "The compression of the layer blobs (none, gzip or zstd)")
 
 }
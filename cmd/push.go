@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/nlewo/nix2container/nix"
+	"github.com/nlewo/nix2container/registry"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var pushCredentials string
+var pushPlainHTTP bool
+var pushTLSVerify bool
+
+var pushCmd = &cobra.Command{
+	Use:   "push IMAGE.JSON REFERENCE",
+	Short: "Push the image (or the image index) described by IMAGE.JSON to a registry, at REFERENCE such as localhost:5000/hello:latest",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := push(args[0], args[1])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			os.Exit(1)
+		}
+	},
+}
+
+func push(imageFilename, reference string) error {
+	client := registry.NewClient(pushTLSVerify)
+	client.PlainHTTP = pushPlainHTTP
+	// The credentials are not the default value of the flag since
+	// it would be printed by the usage
+	credentials := pushCredentials
+	if credentials == "" {
+		credentials = os.Getenv("NIX2CONTAINER_CREDS")
+	}
+	if credentials != "" {
+		username, password, ok := strings.Cut(credentials, ":")
+		if !ok {
+			return fmt.Errorf("credentials are expected to be USERNAME:PASSWORD")
+		}
+		client.Username = username
+		client.Password = password
+	}
+	isIndex, err := nix.IsImageIndexFile(imageFilename)
+	if err != nil {
+		return err
+	}
+	if isIndex {
+		index, err := nix.NewImageIndexFromFile(imageFilename)
+		if err != nil {
+			return err
+		}
+		err = client.PushIndex(index, reference)
+		if err != nil {
+			return err
+		}
+	} else {
+		image, err := nix.NewImageFromFile(imageFilename)
+		if err != nil {
+			return err
+		}
+		err = client.Push(image, reference)
+		if err != nil {
+			return err
+		}
+	}
+	logrus.Infof("Image has been pushed to %s", reference)
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(pushCmd)
+	pushCmd.Flags().StringVarP(&pushCredentials, "creds", "", "", "The registry credentials USERNAME:PASSWORD (defaults to the NIX2CONTAINER_CREDS environment variable)")
+	pushCmd.Flags().BoolVarP(&pushPlainHTTP, "plain-http", "", false, "Use HTTP instead of HTTPS to connect to the registry")
+	pushCmd.Flags().BoolVarP(&pushTLSVerify, "tls-verify", "", true, "Verify the registry certificate")
+}
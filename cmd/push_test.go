@@ -0,0 +1,26 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPushUsageHidesCredentials(t *testing.T) {
+	// The flags are registered when the package is initialized: the
+	// usage is then printed by a test process started with the
+	// credentials in its environment.
+	if os.Getenv("NIX2CONTAINER_CREDS") != "" {
+		fmt.Print(pushCmd.UsageString())
+		return
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestPushUsageHidesCredentials$")
+	cmd.Env = append(os.Environ(), "NIX2CONTAINER_CREDS=user:secret")
+	out, err := cmd.CombinedOutput()
+	assert.Nil(t, err)
+	assert.Contains(t, string(out), "--creds")
+	assert.NotContains(t, string(out), "user:secret")
+}
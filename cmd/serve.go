@@ -0,0 +1,72 @@
+package cmd
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nlewo/nix2container/nix"
+	"github.com/nlewo/nix2container/registry"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var serveListen string
+
+var serveCmd = &cobra.Command{
+	Use:   "serve [NAME:TAG=]IMAGE.JSON ...",
+	Short: "Serve images described by image JSON files over the pull endpoints of the OCI distribution API",
+	Long: `Serve images described by image JSON files over the pull endpoints of the OCI distribution API.
+
+Layers are built on demand from the Nix store. When the NAME:TAG of an
+image is not provided, it is derived from the file name: for instance,
+/nix/store/<hash>-image-hello.json is served as hello:latest.`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		err := serve(serveListen, args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// parseServeArg parses an argument such as hello:1.0=image.json.
+func parseServeArg(arg string) (name, tag, filename string) {
+	ref, filename, ok := strings.Cut(arg, "=")
+	if !ok {
+		filename = arg
+		ref = filepath.Base(filename)
+		ref = nix.StorePathHash.ReplaceAllString(ref, "")
+		ref = strings.TrimPrefix(ref, "image-")
+		ref = strings.TrimSuffix(ref, ".json")
+	}
+	name, tag, ok = strings.Cut(ref, ":")
+	if !ok {
+		tag = "latest"
+	}
+	return name, tag, filename
+}
+
+func serve(listen string, args []string) error {
+	server := registry.NewServer()
+	for _, arg := range args {
+		name, tag, filename := parseServeArg(arg)
+		image, err := nix.NewImageFromFile(filename)
+		if err != nil {
+			return err
+		}
+		if err := server.AddImage(name, tag, image); err != nil {
+			return err
+		}
+	}
+	logrus.Infof("Listening on %s", listen)
+	return http.ListenAndServe(listen, server)
+}
+
+func init() {
+	rootCmd.AddCommand(serveCmd)
+	serveCmd.Flags().StringVarP(&serveListen, "listen", "", ":5000", "The address the registry listens on")
+}
@@ -2,8 +2,10 @@ package cmd
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
 
+	"github.com/nlewo/nix2container/nix"
 	"github.com/nlewo/nix2container/types"
 
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
@@ -18,6 +20,9 @@ func readPermsFile(filename string) (permPaths []types.PermPath, err error) {
 	if err != nil {
 		return permPaths, err
 	}
+	if err := nix.ValidatePermPaths(permPaths); err != nil {
+		return permPaths, fmt.Errorf("invalid perms file '%s': %w", filename, err)
+	}
 	return
 }
 
@@ -30,6 +35,75 @@ func readRewritesFile(filename string) (rewritePaths []types.RewritePath, err er
 	if err != nil {
 		return rewritePaths, err
 	}
+	if err := nix.ValidateRewrites(rewritePaths); err != nil {
+		return rewritePaths, fmt.Errorf("invalid rewrites file '%s': %w", filename, err)
+	}
+	return
+}
+
+func readGroupsFile(filename string) (layerGroups []types.LayerGroup, err error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return layerGroups, err
+	}
+	err = json.Unmarshal(content, &layerGroups)
+	if err != nil {
+		return layerGroups, err
+	}
+	if err := nix.ValidateLayerGroups(layerGroups); err != nil {
+		return layerGroups, fmt.Errorf("invalid groups file '%s': %w", filename, err)
+	}
+	return
+}
+
+func readLayerPlanFile(filename string) (plan types.LayerPlan, err error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return plan, err
+	}
+	err = json.Unmarshal(content, &plan)
+	if err != nil {
+		return plan, err
+	}
+	return
+}
+
+func readDirectoryPermsFile(filename string) (perms []types.Perm, err error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return perms, err
+	}
+	err = json.Unmarshal(content, &perms)
+	if err != nil {
+		return perms, err
+	}
+	if err := nix.ValidatePerms(perms); err != nil {
+		return perms, fmt.Errorf("invalid directory perms file '%s': %w", filename, err)
+	}
+	return
+}
+
+func readEntriesFile(filename string) (entries []types.Entry, err error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return entries, err
+	}
+	err = json.Unmarshal(content, &entries)
+	if err != nil {
+		return entries, err
+	}
+	return
+}
+
+func readDeletionsFile(filename string) (deletions []types.Deletion, err error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return deletions, err
+	}
+	err = json.Unmarshal(content, &deletions)
+	if err != nil {
+		return deletions, err
+	}
 	return
 }
 
@@ -14,7 +14,7 @@ let
         ./data
       ]);
     };
-    vendorHash = "sha256-KPJSt2QTcyIgC6S/ASuc1xSEIXrPDFMnd+5MhCQqia4=";
+    vendorHash = "sha256-Hce7XKFg4K46CrThoisD6Q211LUX+Ws86rmcI+Y/l04=";
     ldflags = l.optional pkgs.stdenv.isDarwin
       "-X github.com/nlewo/nix2container/nix.useNixCaseHack=true";
   };
@@ -227,12 +227,80 @@ let
     #   mode = "0664";
     # }
     # The mode is applied on a specific path. In this path subtree,
-    # the mode is then applied on all files matching the regex.
+    # the mode is then applied on all files matching the regex. The
+    # mode can also be a chmod symbolic expression such as "g+w,a+X".
+    # Extended attributes can be set with an `xattrs` attribute such as
+    # { "security.capability" = "cap_net_bind_service=+ep"; }.
+    # The regex is matched against the path in the Nix store unless
+    # match = "destination", and type = "file", "dir", "symlink" or
+    # "executable" restricts the kind of files it applies to.
     perms ? [],
+    # A list of rewrites of the file paths, applied in order after
+    # the rewrites moving the copyToRoot store paths to the image root.
+    #
+    # Each element of this list is a dict such as
+    # { path = app; regex = "^/share/"; repl = "/usr/share/"; }
+    rewrites ? [],
+    # A list of permissions of the directories which are not in the
+    # Nix store but created as parents of files, such as /nix/store
+    # or /home/app. They are root:root 0755 by default.
+    #
+    # Each element of this list is a dict such as
+    # { regex = "^/home/app$"; mode = "0700"; uid = 1000; gid = 1000; }
+    # The regex is matched against the path of the directory in the
+    # image.
+    directoryPerms ? [],
     # The maximun number of layer to create. This is based on the
     # store path "popularity" as described in
     # https://grahamc.com/blog/nix-and-layered-docker-images
     maxLayers ? 1,
+    # The maximum size of a layer blob, in bytes: bigger layers are
+    # split in several layers. null means unlimited.
+    maxLayerSize ? null,
+    # The strategy used to group store paths in maxLayers layers:
+    # "popularity" isolates the most popular store paths while "size"
+    # creates layers of similar sizes: big store paths are isolated
+    # while small ones are merged.
+    layeringStrategy ? "popularity",
+    # A list of named layer groups: the store paths matching the regex
+    # of a group are put in a layer whose history comment is the group
+    # name. Other store paths are grouped with layeringStrategy in the
+    # layers left by the groups out of maxLayers, at least one.
+    #
+    # Each element of this list is a dict such as
+    # { name = "python";
+    #   regex = "-python3\\.[0-9]+";
+    # }
+    layerGroups ? [],
+    # A list of files, directories, symlinks and device nodes which are
+    # not in the Nix store, created by the first layer.
+    #
+    # Each element of this list is a dict such as
+    # { type = "directory"; path = "/tmp"; mode = "1777"; }
+    # The type is file, directory, symlink, char-device or
+    # block-device. A file has a content, a symlink a target and a
+    # device node its major and minor numbers. The owner is set with
+    # uid, gid, uname and gname.
+    entries ? [],
+    # A list of files or directories of the lower layers, such as the
+    # layers of a base image, deleted by the first layer.
+    #
+    # Each element of this list is a dict such as
+    # { path = "/etc/motd"; }
+    # If opaque = true, the directory path is not deleted but its
+    # content coming from the lower layers is hidden.
+    deletions ? [],
+    # Write files sharing their inode, such as files deduplicated by
+    # the Nix store optimisation, as hard links. The Nix store used
+    # to push the image must then be optimised as the one used to
+    # build it, otherwise the layer digests differ.
+    preserveHardLinks ? false,
+    # A layer plan file, written by a previous build to
+    # $out/layer-plan.json: store paths of this plan keep their layer
+    # and only new store paths are grouped with layeringStrategy.
+    layerPlan ? null,
+    # The compression of the layer blobs: "none", "gzip" or "zstd".
+    compression ? "none",
     # Deprecated: will be removed on v1
     contents ? null,
     # Author, comment, created_by
@@ -246,18 +314,32 @@ let
 
     # This is to move all storepaths in the copyToRoot attribute to the
     # image root.
-    rewrites = map (p: {
+    copyToRootRewrites = map (p: {
 	    path = p;
 	    regex = "^${p}";
 	    repl = "";
-    }) copyToRootList;
+    }) (l.unique copyToRootList);
 
-    rewritesFile = pkgs.writeText "rewrites.json" (l.toJSON rewrites);
+    rewritesFile = pkgs.writeText "rewrites.json" (l.toJSON (copyToRootRewrites ++ rewrites));
     rewritesFlag = "--rewrites ${rewritesFile}";
 
     permsFile = pkgs.writeText "perms.json" (l.toJSON perms);
     permsFlag = l.optionalString (perms != []) "--perms ${permsFile}";
 
+    directoryPermsFile = pkgs.writeText "directory-perms.json" (l.toJSON directoryPerms);
+    directoryPermsFlag = l.optionalString (directoryPerms != []) "--directory-perms ${directoryPermsFile}";
+
+    groupsFile = pkgs.writeText "groups.json" (l.toJSON layerGroups);
+    groupsFlag = l.optionalString (layerGroups != []) "--groups ${groupsFile}";
+
+    entriesFile = pkgs.writeText "entries.json" (l.toJSON entries);
+    entriesFlag = l.optionalString (entries != []) "--entries ${entriesFile}";
+
+    deletionsFile = pkgs.writeText "deletions.json" (l.toJSON deletions);
+    deletionsFlag = l.optionalString (deletions != []) "--deletions ${deletionsFile}";
+
+    layerPlanFlag = l.optionalString (layerPlan != null) "--layer-plan ${layerPlan}";
+
     historyFile = pkgs.writeText "history.json" (l.toJSON metadata);
     historyFlag = l.optionalString (metadata != {}) "--history ${historyFile}";
 
@@ -271,8 +353,19 @@ let
         $out/layers.json \
         ${closureGraph allDeps ignore} \
         --max-layers ${toString maxLayers} \
+        --jobs $NIX_BUILD_CORES \
+        ${l.optionalString (maxLayerSize != null) "--max-layer-size ${toString maxLayerSize}"} \
+        --compression ${compression} \
+        --strategy ${layeringStrategy} \
         ${rewritesFlag} \
         ${permsFlag} \
+        ${directoryPermsFlag} \
+        ${groupsFlag} \
+        ${entriesFlag} \
+        ${deletionsFlag} \
+        ${l.optionalString preserveHardLinks "--hard-links"} \
+        ${layerPlanFlag} \
+        --write-layer-plan $out/layer-plan.json \
         ${historyFlag} \
         ${tarDirectory} \
         ${toString (map (l: l + "/layers.json") layers)}
@@ -344,23 +437,39 @@ let
     fromImage ? "",
     # Image architecture
     arch ? pkgs.go.GOARCH,
+    # Image CPU variant, such as "v7" for the arm architecture
+    variant ? "",
     # A list of file permisssions which are set when the tar layer is
-    # created: these permissions are not written to the Nix store.
-    #
-    # Each element of this permission list is a dict such as
-    # { path = "a store path";
-    #   regex = ".*";
-    #   mode = "0664";
-    # }
-    # The mode is applied on a specific path. In this path subtree,
-    # the mode is then applied on all files matching the regex.
+    # created (see buildLayer.perms)
     perms ? [],
+    # A list of rewrites of the file paths (see buildLayer.rewrites)
+    rewrites ? [],
+    # A list of permissions of the directories which are not in the
+    # Nix store, such as /home/app (see buildLayer.directoryPerms)
+    directoryPerms ? [],
     # The maximun number of layer to create. This is based on the
     # store path "popularity" as described in
     # https://grahamc.com/blog/nix-and-layered-docker-images
     # Note this is applied on the image layers and not on layers added
     # with the buildImage.layers attribute
     maxLayers ? 1,
+    # A list of files, directories, symlinks and device nodes which are
+    # not in the Nix store, created by the image (see buildLayer.entries)
+    entries ? [],
+    # A list of files or directories of the lower layers, such as the
+    # layers of fromImage, deleted by the image (see buildLayer.deletions)
+    deletions ? [],
+    # Write files sharing their inode as hard links (see
+    # buildLayer.preserveHardLinks)
+    preserveHardLinks ? false,
+    # The maximum number of layers of the image, including the layers
+    # of fromImage and the buildImage.layers attribute: the least
+    # popular adjacent layers are merged to stay below this limit.
+    # 0 means unlimited.
+    maxImageLayers ? 127,
+    # The maximum size of a layer blob, in bytes: bigger layers are
+    # split in several layers. null means unlimited.
+    maxLayerSize ? null,
     # If set to true, the Nix database is initialized with all store
     # paths added into the image. Note this is only useful to run nix
     # commands from the image, for instance to build an image used by
@@ -398,7 +507,7 @@ let
         };
 
       customizationLayer = buildLayer {
-        inherit maxLayers;
+        inherit maxLayers maxLayerSize rewrites directoryPerms entries deletions preserveHardLinks;
         perms = perms';
         copyToRoot = copyToRootList ++ l.optional initializeNixDatabase nixDatabase;
         deps = [configFile];
@@ -407,7 +516,7 @@ let
       };
 
       fromImageFlag = l.optionalString (fromImage != "") "--from-image ${fromImage}";
-      archFlag = "--arch ${arch}";
+      archFlag = "--arch ${arch}" + l.optionalString (variant != "") " --variant ${variant}";
       createdFlag = "--created ${created}";
       layerPaths = l.concatMapStringsSep " " (l: l + "/layers.json") (allLayers ++ [customizationLayer]);
 
@@ -437,6 +546,7 @@ let
         ${fromImageFlag} \
         ${archFlag} \
         ${createdFlag} \
+        --max-image-layers ${toString maxImageLayers} \
         ${configFile} \
         ${layerPaths}
         set +x
@@ -0,0 +1,220 @@
+package nix
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/nlewo/nix2container/types"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultMaxImageLayers is the default maximum number of layers of an
+// image: overlayfs and Docker don't support much more layers.
+const DefaultMaxImageLayers = 127
+
+// isMergeable returns true if the layer can be built again from its
+// paths. Layers of a base image, which don't have paths, and non
+// reproducible layers, whose tarball is stored in LayerPath, can not
+// be merged. Layers with deletions can not be merged either since
+// their deletions apply to the layers below them.
+func isMergeable(layer types.Layer) bool {
+	return len(layer.Paths) > 0 && layer.LayerPath == "" && len(layer.Deletions) == 0
+}
+
+// MergeLayers merges adjacent layers to get at most maxLayers layers.
+// The adjacent pair of layers with the lowest popularity is merged
+// first, the last pair being chosen when several pairs have the same
+// popularity. Only mergeable layers (see isMergeable) built with the
+// same tar options (see sameTarOptions) and whose files don't overlap
+// (see overlap) are merged: the files of a layer overriding the files
+// of a lower layer are then kept. An error is returned if there are
+// not enough mergeable layers. If maxLayers is 0, layers are not
+// merged.
+func MergeLayers(layers []types.Layer, maxLayers int) ([]types.Layer, error) {
+	excess := len(layers) - maxLayers
+	if maxLayers <= 0 || excess <= 0 {
+		return layers, nil
+	}
+	logrus.Infof("Merging layers since there are %d layers while the maximum is %d", len(layers), maxLayers)
+	runs := make([]layerRun, len(layers))
+	for i, layer := range layers {
+		runs[i].layers = []types.Layer{layer}
+		if isMergeable(layer) {
+			destinations, err := layerDestinations(layer)
+			if err != nil {
+				return nil, err
+			}
+			runs[i].destinations = destinations
+		}
+	}
+	for ; excess > 0; excess-- {
+		best := -1
+		var bestPopularity int64
+		for i := 0; i+1 < len(runs); i++ {
+			if !canMergeRuns(runs[i], runs[i+1]) {
+				continue
+			}
+			popularity := runPopularity(runs[i].layers) + runPopularity(runs[i+1].layers)
+			if best == -1 || popularity <= bestPopularity {
+				best, bestPopularity = i, popularity
+			}
+		}
+		if best == -1 {
+			return nil, fmt.Errorf("the image has %d layers while the maximum is %d and there are not enough adjacent layers built from store paths to merge", len(runs), maxLayers)
+		}
+		runs[best].layers = append(runs[best].layers, runs[best+1].layers...)
+		for path, isDir := range runs[best+1].destinations {
+			addDestination(runs[best].destinations, path, isDir)
+		}
+		runs = slices.Delete(runs, best+1, best+2)
+	}
+	res := make([]types.Layer, 0, len(runs))
+	for _, run := range runs {
+		if len(run.layers) == 1 {
+			res = append(res, run.layers[0])
+			continue
+		}
+		merged, err := mergeLayers(run.layers)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, merged)
+	}
+	return res, nil
+}
+
+// layerRun is a run of adjacent layers merged together, with the
+// destination paths of their files (see layerDestinations).
+type layerRun struct {
+	layers       []types.Layer
+	destinations map[string]bool
+}
+
+// canMergeRuns returns true if the layers of both runs can be merged
+// into a single layer.
+func canMergeRuns(a, b layerRun) bool {
+	if !isMergeable(a.layers[0]) || !isMergeable(b.layers[0]) || !sameTarOptions(a.layers[0], b.layers[0]) {
+		return false
+	}
+	return !overlap(a.destinations, b.destinations)
+}
+
+// overlap returns true if a destination path of a is also in b, while
+// it is not a directory in both of them: the file of the upper layer
+// would then override the file of the lower layer, which can not be
+// expressed by a single layer.
+func overlap(a, b map[string]bool) bool {
+	if len(b) < len(a) {
+		a, b = b, a
+	}
+	for path, isDir := range a {
+		if otherIsDir, ok := b[path]; ok && (!isDir || !otherIsDir) {
+			return true
+		}
+	}
+	return false
+}
+
+// layerDestinations returns the destination paths of the files of the
+// paths and the entries of layer, as well as their parent directories.
+// The value is true for directories. Entries are never considered as
+// directories since their metadata can differ from a directory of
+// another layer.
+func layerDestinations(layer types.Layer) (map[string]bool, error) {
+	destinations := make(map[string]bool)
+	for _, p := range layer.Paths {
+		options, err := compilePathOptions(p.Options)
+		if err != nil {
+			return nil, fmt.Errorf("invalid options of the path '%s': %w", p.Path, err)
+		}
+		directoryOnly := p.DirectoryOnly
+		err = filepath.Walk(p.Path, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return fmt.Errorf("failed accessing path %q: %v", path, err)
+			}
+			if dstPath := destinationPath(path, options); dstPath != "" {
+				addDestination(destinations, dstPath, info.IsDir())
+			}
+			if directoryOnly && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, entry := range layer.Entries {
+		addDestination(destinations, entry.Path, false)
+	}
+	return destinations, nil
+}
+
+// addDestination adds the destination path and its parent directories
+// to destinations. A path is a directory only if it is a directory in
+// all the layers adding it.
+func addDestination(destinations map[string]bool, path string, isDir bool) {
+	path = filepath.Clean(path)
+	current, ok := destinations[path]
+	destinations[path] = isDir && (!ok || current)
+	for dir := filepath.Dir(path); dir != path; path, dir = dir, filepath.Dir(dir) {
+		if _, ok := destinations[dir]; !ok {
+			destinations[dir] = true
+		}
+	}
+}
+
+// runPopularity returns the sum of the popularity of layers.
+func runPopularity(layers []types.Layer) (popularity int64) {
+	for _, layer := range layers {
+		popularity += layer.Popularity
+	}
+	return popularity
+}
+
+// sameTarOptions returns true if both layers have the same media type,
+// hard links setting and directory perms.
+func sameTarOptions(a, b types.Layer) bool {
+	return a.MediaType == b.MediaType && a.HardLinks == b.HardLinks && reflect.DeepEqual(a.DirectoryPerms, b.DirectoryPerms)
+}
+
+// mergeLayers builds a layer containing the paths and the entries of
+// layers. Its history is the history of the first layer, with the
+// comments of all layers, and its popularity is the sum of the
+// popularity of layers.
+func mergeLayers(layers []types.Layer) (types.Layer, error) {
+	var paths types.Paths
+	var entries []types.Entry
+	var comments []string
+	for _, layer := range layers {
+		paths = append(paths, layer.Paths...)
+		entries = append(entries, layer.Entries...)
+		if layer.History.Comment != "" && !slices.Contains(comments, layer.History.Comment) {
+			comments = append(comments, layer.History.Comment)
+		}
+	}
+	compression := compressionFromMediaType(layers[0].MediaType)
+	digest, diffID, size, err := TarPathsSum(paths, entries, nil, layers[0].DirectoryPerms, layers[0].HardLinks, compression)
+	if err != nil {
+		return types.Layer{}, fmt.Errorf("failed to merge %d layers: %w", len(layers), err)
+	}
+	logrus.Infof("Merged %d layers into the layer %s (size:%d)", len(layers), digest, size)
+	history := layers[0].History
+	history.Comment = strings.Join(comments, ", ")
+	return types.Layer{
+		Digest:         digest.String(),
+		DiffIDs:        diffID.String(),
+		Size:           size,
+		Paths:          paths,
+		Entries:        entries,
+		DirectoryPerms: layers[0].DirectoryPerms,
+		HardLinks:      layers[0].HardLinks,
+		Popularity:     runPopularity(layers),
+		MediaType:      layers[0].MediaType,
+		History:        history,
+	}, nil
+}
@@ -0,0 +1,127 @@
+package nix
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/nlewo/nix2container/types"
+	"github.com/stretchr/testify/assert"
+
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+var budgetTestPaths = []string{
+	"../data/layer1/file1",
+	"../data/tar-directory/file1",
+	"../data/tar-directory/symlink",
+}
+
+func TestMergeLayers(t *testing.T) {
+	base := types.Layer{Digest: "sha256:base"}
+	layers := append([]types.Layer{base}, newTestLayers(t, budgetTestPaths, LayerOptions{MaxLayers: 3})...)
+
+	merged, err := MergeLayers(layers, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, layers, merged)
+	merged, err = MergeLayers(layers, 4)
+	assert.Nil(t, err)
+	assert.Equal(t, layers, merged)
+
+	// The two last layers are merged
+	merged, err = MergeLayers(layers, 3)
+	assert.Nil(t, err)
+	assert.Equal(t, append([]types.Layer{base}, newTestLayers(t, budgetTestPaths, LayerOptions{MaxLayers: 2})...), merged)
+
+	// All layers built from store paths are merged
+	merged, err = MergeLayers(layers, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, append([]types.Layer{base}, newTestLayers(t, budgetTestPaths, LayerOptions{MaxLayers: 1})...), merged)
+
+	// The base image layer can not be merged
+	_, err = MergeLayers(layers, 1)
+	assert.ErrorContains(t, err, "the image has 2 layers while the maximum is 1")
+
+	// A non reproducible layer is left alone
+	nonReproducible := types.Layer{Digest: "sha256:non-reproducible", Paths: types.Paths{{Path: "../data/layer1"}}, LayerPath: "/nix/store/layer.tar"}
+	layers = newTestLayers(t, budgetTestPaths, LayerOptions{MaxLayers: 3})
+	layers = []types.Layer{layers[0], layers[1], nonReproducible, layers[2]}
+	merged, err = MergeLayers(layers, 3)
+	assert.Nil(t, err)
+	assert.Len(t, merged, 3)
+	assert.Equal(t, slices.Concat(layers[0].Paths, layers[1].Paths), merged[0].Paths)
+	assert.Equal(t, nonReproducible, merged[1])
+	assert.Equal(t, layers[3], merged[2])
+}
+
+func TestMergeLayersHistory(t *testing.T) {
+	layers := newTestLayers(t, budgetTestPaths, LayerOptions{MaxLayers: 3})
+	layers[0].History = v1.History{CreatedBy: "nix2container", Comment: "a"}
+	layers[1].History = v1.History{CreatedBy: "nix2container", Comment: "b"}
+	layers[2].History = v1.History{CreatedBy: "nix2container", Comment: "a"}
+	merged, err := MergeLayers(layers, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, v1.History{CreatedBy: "nix2container", Comment: "a, b"}, merged[0].History)
+}
+
+func TestMergeLayersPopularity(t *testing.T) {
+	layers := newTestLayers(t, budgetTestPaths, LayerOptions{MaxLayers: 3})
+	layers[0].Popularity = 1
+	layers[1].Popularity = 1
+	layers[2].Popularity = 10
+	// The least popular pair is merged even if it is not at the end
+	merged, err := MergeLayers(layers, 2)
+	assert.Nil(t, err)
+	assert.Len(t, merged, 2)
+	assert.Equal(t, slices.Concat(layers[0].Paths, layers[1].Paths), merged[0].Paths)
+	assert.Equal(t, int64(2), merged[0].Popularity)
+	assert.Equal(t, layers[2], merged[1])
+}
+
+func TestMergeLayersEntries(t *testing.T) {
+	layers := newTestLayers(t, budgetTestPaths, LayerOptions{MaxLayers: 3})
+	layers[0].Entries = []types.Entry{{Path: "/etc/a", Type: "file"}}
+	layers[1].Entries = []types.Entry{{Path: "/etc/./a", Type: "file"}}
+	layers[2].Popularity = 5
+	// The least popular layers share an entry path
+	merged, err := MergeLayers(layers, 2)
+	assert.Nil(t, err)
+	assert.Len(t, merged, 2)
+	assert.Equal(t, layers[0], merged[0])
+	assert.Equal(t, slices.Concat(layers[1].Paths, layers[2].Paths), merged[1].Paths)
+
+	_, err = MergeLayers(layers, 1)
+	assert.ErrorContains(t, err, "the image has 2 layers while the maximum is 1")
+}
+
+func TestMergeLayersOverlappingFiles(t *testing.T) {
+	rewrites := []types.RewritePath{
+		{Path: "../data/layer1/file1", Regex: "^.*$", Repl: "/etc/file"},
+		{Path: "../data/tar-directory/file1", Regex: "^.*$", Repl: "/etc/file"},
+	}
+	layers := newTestLayers(t, budgetTestPaths, LayerOptions{MaxLayers: 3, Rewrites: rewrites})
+	layers[2].Popularity = 5
+	// The least popular layers both write /etc/file
+	merged, err := MergeLayers(layers, 2)
+	assert.Nil(t, err)
+	assert.Len(t, merged, 2)
+	assert.Equal(t, layers[0], merged[0])
+	assert.Equal(t, slices.Concat(layers[1].Paths, layers[2].Paths), merged[1].Paths)
+
+	_, err = MergeLayers(layers, 1)
+	assert.ErrorContains(t, err, "the image has 2 layers while the maximum is 1")
+}
+
+func TestOverlap(t *testing.T) {
+	a := make(map[string]bool)
+	addDestination(a, "/etc/passwd", false)
+	b := make(map[string]bool)
+	addDestination(b, "/etc/group", false)
+	assert.False(t, overlap(a, b))
+	// A file replacing a parent directory of another layer
+	c := make(map[string]bool)
+	addDestination(c, "/etc", false)
+	assert.True(t, overlap(a, c))
+	d := make(map[string]bool)
+	addDestination(d, "/etc/passwd", false)
+	assert.True(t, overlap(a, d))
+}
@@ -0,0 +1,209 @@
+package nix
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/nlewo/nix2container/types"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+// DigestCache is an on-disk cache of the digests and the sizes of
+// reproducible layers. Since store paths are immutable, a layer is
+// identified by its store paths, its options and the nix2container
+// executable which computed it. Layers containing paths which are not
+// in the Nix store are then never cached. Layers preserving hard links
+// are not cached either since the files sharing an inode in the Nix
+// store change when it is optimised or garbage collected.
+type DigestCache struct {
+	dir string
+	// The Nix store directory, such as /nix/store
+	storeDir string
+	// The digest of the executable, to invalidate the cache when
+	// the tar stream of layers could change
+	executable string
+	// If true, cached digests are computed again and checked
+	verify bool
+}
+
+// cachedDigest is the content of a file of the DigestCache.
+type cachedDigest struct {
+	Digest string `json:"digest"`
+	DiffID string `json:"diff-id"`
+	Size   int64  `json:"size"`
+}
+
+// cacheKey describes what the tar stream of a layer depends on.
+type cacheKey struct {
+	Executable     string           `json:"executable"`
+	Paths          types.Paths      `json:"paths"`
+	Entries        []types.Entry    `json:"entries"`
+	Deletions      []types.Deletion `json:"deletions"`
+	DirectoryPerms []types.Perm     `json:"directory-perms"`
+	HardLinks      bool             `json:"hard-links"`
+	NixCaseHack    string           `json:"nix-case-hack"`
+	Compression    Compression      `json:"compression"`
+}
+
+// NewDigestCache creates the cache directory dir if it doesn't exist.
+// If verify is true, the cached digests are computed again and an
+// error is returned if they changed.
+func NewDigestCache(dir string, verify bool) (*DigestCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(executable)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() // nolint: errcheck
+	d, err := digest.Canonical.FromReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("could not compute the digest of the executable '%s': %w", executable, err)
+	}
+	storeDir := os.Getenv("NIX_STORE_DIR")
+	if storeDir == "" {
+		storeDir = "/nix/store"
+	}
+	return &DigestCache{dir: dir, storeDir: storeDir, executable: d.String(), verify: verify}, nil
+}
+
+// cacheable returns true if all paths are in the Nix store and hard
+// links are not preserved.
+func (c *DigestCache) cacheable(paths types.Paths, hardLinks bool) bool {
+	if hardLinks {
+		return false
+	}
+	for _, p := range paths {
+		if !strings.HasPrefix(filepath.Clean(p.Path), c.storeDir+"/") {
+			return false
+		}
+	}
+	return true
+}
+
+// filename returns the cache file of a layer.
+func (c *DigestCache) filename(paths types.Paths, entries []types.Entry, deletions []types.Deletion, directoryPerms []types.Perm, hardLinks bool, compression Compression) (string, error) {
+	key, err := json.Marshal(cacheKey{
+		Executable:     c.executable,
+		Paths:          paths,
+		Entries:        entries,
+		Deletions:      deletions,
+		DirectoryPerms: directoryPerms,
+		HardLinks:      hardLinks,
+		NixCaseHack:    useNixCaseHack,
+		Compression:    compression,
+	})
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(key)
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+".json"), nil
+}
+
+// read returns the cached digest of filename, or nil if it is not
+// cached.
+func (c *DigestCache) read(filename string) (*cachedDigest, error) {
+	content, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cached cachedDigest
+	if err := json.Unmarshal(content, &cached); err != nil {
+		logrus.Warnf("Ignoring the invalid cache file %s: %v", filename, err)
+		return nil, nil
+	}
+	return &cached, nil
+}
+
+// write atomically writes a digest to the cache file filename.
+func (c *DigestCache) write(filename string, cached cachedDigest) error {
+	content, err := json.Marshal(cached)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(c.dir, "")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // nolint: errcheck
+	if _, err := f.Write(content); err != nil {
+		f.Close() // nolint: errcheck
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filename)
+}
+
+// TarPathsSum returns the digests and the size of a layer (see
+// TarPathsSum) from the cache. When it is not cached, or if the cache
+// is verified, they are computed until ctx is done: they are then added to the cache by
+// Add, once the layer is known to be kept. A nil cache always computes
+// them, as well as a cache when the layer can not be cached (see
+// cacheable).
+func (c *DigestCache) TarPathsSum(ctx context.Context, paths types.Paths, entries []types.Entry, deletions []types.Deletion, directoryPerms []types.Perm, hardLinks bool, compression Compression) (digest.Digest, digest.Digest, int64, error) {
+	if c == nil || !c.cacheable(paths, hardLinks) {
+		return sumTarPaths(ctx, nil, paths, entries, deletions, directoryPerms, hardLinks, compression)
+	}
+	filename, err := c.filename(paths, entries, deletions, directoryPerms, hardLinks, compression)
+	if err != nil {
+		return "", "", 0, err
+	}
+	cached, err := c.read(filename)
+	if err != nil {
+		return "", "", 0, err
+	}
+	if cached != nil && !c.verify {
+		logrus.Debugf("Using the cached digest %s of the layer of %d paths", cached.Digest, len(paths))
+		return digest.Digest(cached.Digest), digest.Digest(cached.DiffID), cached.Size, nil
+	}
+	d, diffID, size, err := sumTarPaths(ctx, nil, paths, entries, deletions, directoryPerms, hardLinks, compression)
+	if err != nil {
+		return "", "", 0, err
+	}
+	if cached != nil {
+		computed := cachedDigest{Digest: d.String(), DiffID: diffID.String(), Size: size}
+		if *cached != computed {
+			return "", "", 0, fmt.Errorf("the cache file '%s' contains the digest %s (size:%d) while the digest of the layer is %s (size:%d)", filename, cached.Digest, cached.Size, computed.Digest, computed.Size)
+		}
+	}
+	return d, diffID, size, nil
+}
+
+// Add writes the digests and the size of a layer, computed by
+// TarPathsSum, to the cache if it is not already cached. Nothing is
+// written by a nil cache or if the layer can not be cached (see
+// cacheable).
+func (c *DigestCache) Add(paths types.Paths, entries []types.Entry, deletions []types.Deletion, directoryPerms []types.Perm, hardLinks bool, compression Compression, d, diffID digest.Digest, size int64) error {
+	if c == nil || !c.cacheable(paths, hardLinks) {
+		return nil
+	}
+	filename, err := c.filename(paths, entries, deletions, directoryPerms, hardLinks, compression)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(filename); err == nil {
+		return nil
+	}
+	if err := c.write(filename, cachedDigest{Digest: d.String(), DiffID: diffID.String(), Size: size}); err != nil {
+		return fmt.Errorf("could not write the cache file '%s': %w", filename, err)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package nix
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nlewo/nix2container/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDigestCache(t *testing.T) {
+	paths := types.Paths{{Path: "../data/tar-directory"}}
+	expectedDigest, expectedDiffID, expectedSize, err := TarPathsSum(paths, nil, nil, nil, false, CompressionNone)
+	assert.Nil(t, err)
+
+	// A nil cache computes the digests
+	var nilCache *DigestCache
+	d, diffID, size, err := nilCache.TarPathsSum(context.Background(), paths, nil, nil, nil, false, CompressionNone)
+	assert.Nil(t, err)
+	assert.Equal(t, expectedDigest, d)
+
+	dir := t.TempDir()
+	cache, err := NewDigestCache(dir, false)
+	assert.Nil(t, err)
+
+	// Paths which are not in the Nix store are not cached
+	d, diffID, size, err = cache.TarPathsSum(context.Background(), paths, nil, nil, nil, false, CompressionNone)
+	assert.Nil(t, err)
+	assert.Equal(t, expectedDigest, d)
+	assert.Nil(t, cache.Add(paths, nil, nil, nil, false, CompressionNone, d, diffID, size))
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	assert.Nil(t, err)
+	assert.Len(t, files, 0)
+
+	cache.storeDir = "../data"
+	d, diffID, size, err = cache.TarPathsSum(context.Background(), paths, nil, nil, nil, false, CompressionNone)
+	assert.Nil(t, err)
+	assert.Equal(t, expectedDigest, d)
+	assert.Equal(t, expectedDiffID, diffID)
+	assert.Equal(t, expectedSize, size)
+	assert.Nil(t, cache.Add(paths, nil, nil, nil, false, CompressionNone, d, diffID, size))
+	files, err = filepath.Glob(filepath.Join(dir, "*.json"))
+	assert.Nil(t, err)
+	assert.Len(t, files, 1)
+
+	// The options are part of the cache key
+	d, diffID, size, err = cache.TarPathsSum(context.Background(), paths, nil, nil, nil, false, CompressionGzip)
+	assert.Nil(t, err)
+	assert.Nil(t, cache.Add(paths, nil, nil, nil, false, CompressionGzip, d, diffID, size))
+	files, err = filepath.Glob(filepath.Join(dir, "*.json"))
+	assert.Nil(t, err)
+	assert.Len(t, files, 2)
+
+	// Cached digests are not computed again
+	filename, err := cache.filename(paths, nil, nil, nil, false, CompressionNone)
+	assert.Nil(t, err)
+	fake := `{"digest":"sha256:0000000000000000000000000000000000000000000000000000000000000000","diff-id":"sha256:0000000000000000000000000000000000000000000000000000000000000000","size":1}`
+	assert.Nil(t, os.WriteFile(filename, []byte(fake), 0644))
+	d, _, size, err = cache.TarPathsSum(context.Background(), paths, nil, nil, nil, false, CompressionNone)
+	assert.Nil(t, err)
+	assert.Equal(t, "sha256:0000000000000000000000000000000000000000000000000000000000000000", d.String())
+	assert.Equal(t, int64(1), size)
+
+	// They are computed again when the cache is verified
+	cache, err = NewDigestCache(dir, true)
+	assert.Nil(t, err)
+	cache.storeDir = "../data"
+	_, _, _, err = cache.TarPathsSum(context.Background(), paths, nil, nil, nil, false, CompressionNone)
+	assert.ErrorContains(t, err, "contains the digest sha256:0000000000000000000000000000000000000000000000000000000000000000 (size:1) while the digest of the layer is "+expectedDigest.String())
+	_, _, _, err = cache.TarPathsSum(context.Background(), paths, nil, nil, nil, false, CompressionGzip)
+	assert.Nil(t, err)
+}
+
+func TestDigestCacheSplitLayers(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := NewDigestCache(dir, false)
+	assert.Nil(t, err)
+	cache.storeDir = "../data"
+
+	// The digest of the too big layer, which is split, is not cached
+	paths := []string{"../data/layer1", "../data/tar-directory"}
+	layers, _, err := NewLayers(paths, LayerOptions{MaxLayerSize: 4096, Cache: cache})
+	assert.Nil(t, err)
+	assert.Len(t, layers, 2)
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	assert.Nil(t, err)
+	assert.Len(t, files, 2)
+}
+
+func TestDigestCacheHardLinks(t *testing.T) {
+	storeDir := t.TempDir()
+	storePath := filepath.Join(storeDir, "hash-app")
+	assert.Nil(t, os.Mkdir(storePath, 0755))
+	for _, file := range []string{"a", "b"} {
+		assert.Nil(t, os.WriteFile(filepath.Join(storePath, file), []byte("content"), 0644))
+	}
+	paths := types.Paths{{Path: storePath}}
+
+	dir := t.TempDir()
+	cache, err := NewDigestCache(dir, false)
+	assert.Nil(t, err)
+	cache.storeDir = storeDir
+	before, diffID, size, err := cache.TarPathsSum(context.Background(), paths, nil, nil, nil, true, CompressionNone)
+	assert.Nil(t, err)
+	assert.Nil(t, cache.Add(paths, nil, nil, nil, true, CompressionNone, before, diffID, size))
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	assert.Nil(t, err)
+	assert.Len(t, files, 0)
+
+	// The files are hard linked, as done by nix-store --optimise
+	assert.Nil(t, os.Remove(filepath.Join(storePath, "b")))
+	assert.Nil(t, os.Link(filepath.Join(storePath, "a"), filepath.Join(storePath, "b")))
+	expected, _, _, err := TarPathsSum(paths, nil, nil, nil, true, CompressionNone)
+	assert.Nil(t, err)
+	assert.NotEqual(t, before, expected)
+	after, _, _, err := cache.TarPathsSum(context.Background(), paths, nil, nil, nil, true, CompressionNone)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, after)
+}
@@ -0,0 +1,134 @@
+package nix
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// capabilityXattr is the extended attribute holding the file
+// capabilities.
+const capabilityXattr = "security.capability"
+
+// capabilities maps the Linux capability names, without their cap_
+// prefix, to their number.
+var capabilities = map[string]uint{
+	"chown":              0,
+	"dac_override":       1,
+	"dac_read_search":    2,
+	"fowner":             3,
+	"fsetid":             4,
+	"kill":               5,
+	"setgid":             6,
+	"setuid":             7,
+	"setpcap":            8,
+	"linux_immutable":    9,
+	"net_bind_service":   10,
+	"net_broadcast":      11,
+	"net_admin":          12,
+	"net_raw":            13,
+	"ipc_lock":           14,
+	"ipc_owner":          15,
+	"sys_module":         16,
+	"sys_rawio":          17,
+	"sys_chroot":         18,
+	"sys_ptrace":         19,
+	"sys_pacct":          20,
+	"sys_admin":          21,
+	"sys_boot":           22,
+	"sys_nice":           23,
+	"sys_resource":       24,
+	"sys_time":           25,
+	"sys_tty_config":     26,
+	"mknod":              27,
+	"lease":              28,
+	"audit_write":        29,
+	"audit_control":      30,
+	"setfcap":            31,
+	"mac_override":       32,
+	"mac_admin":          33,
+	"syslog":             34,
+	"wake_alarm":         35,
+	"block_suspend":      36,
+	"audit_read":         37,
+	"perfmon":            38,
+	"bpf":                39,
+	"checkpoint_restore": 40,
+}
+
+// The header of a VFS_CAP_REVISION_2 security.capability value, as
+// defined in linux/capability.h
+const (
+	vfsCapRevision2       = 0x02000000
+	vfsCapFlagsEffective  = 0x000001
+	vfsCapRevision2Length = 20
+)
+
+// encodeCapabilities converts file capabilities from their textual
+// representation, such as cap_net_bind_service=+ep, to the value of
+// the security.capability extended attribute. The text is a list of
+// space separated clauses such as cap_chown,cap_kill+ep, where the
+// operator is =, + or - and the flags are e (effective), i
+// (inheritable) and p (permitted). The name all means all
+// capabilities.
+func encodeCapabilities(text string) (string, error) {
+	var effective, permitted, inheritable uint64
+	clauses := strings.Fields(text)
+	if len(clauses) == 0 {
+		return "", fmt.Errorf("no capability")
+	}
+	for _, clause := range clauses {
+		i := strings.IndexAny(clause, "=+-")
+		if i == -1 {
+			return "", fmt.Errorf("the clause '%s' has no operator (=, + or -)", clause)
+		}
+		var mask uint64
+		for _, name := range strings.Split(clause[:i], ",") {
+			if name == "all" {
+				for _, n := range capabilities {
+					mask |= 1 << n
+				}
+				continue
+			}
+			n, ok := capabilities[strings.TrimPrefix(strings.ToLower(name), "cap_")]
+			if !ok {
+				return "", fmt.Errorf("unknown capability '%s'", name)
+			}
+			mask |= 1 << n
+		}
+		operator := byte(0)
+		for _, c := range []byte(clause[i:]) {
+			switch c {
+			case '=':
+				effective &^= mask
+				permitted &^= mask
+				inheritable &^= mask
+				operator = '+'
+			case '+', '-':
+				operator = c
+			case 'e', 'i', 'p':
+				flags := map[byte]*uint64{'e': &effective, 'i': &inheritable, 'p': &permitted}[c]
+				if operator == '+' {
+					*flags |= mask
+				} else {
+					*flags &^= mask
+				}
+			default:
+				return "", fmt.Errorf("unknown flag '%c' in the clause '%s' (expected e, i or p)", c, clause)
+			}
+		}
+	}
+
+	value := make([]byte, vfsCapRevision2Length)
+	magic := uint32(vfsCapRevision2)
+	// File capabilities only have a single effective bit
+	if effective != 0 {
+		magic |= vfsCapFlagsEffective
+	}
+	binary.LittleEndian.PutUint32(value[0:], magic)
+	binary.LittleEndian.PutUint32(value[4:], uint32(permitted))
+	binary.LittleEndian.PutUint32(value[8:], uint32(inheritable))
+	binary.LittleEndian.PutUint32(value[12:], uint32(permitted>>32))
+	binary.LittleEndian.PutUint32(value[16:], uint32(inheritable>>32))
+	return string(value), nil
+}
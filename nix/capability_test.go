@@ -0,0 +1,45 @@
+package nix
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func capabilityValue(magic, permitted, inheritable uint64) string {
+	value := make([]byte, 20)
+	binary.LittleEndian.PutUint32(value[0:], uint32(magic))
+	binary.LittleEndian.PutUint32(value[4:], uint32(permitted))
+	binary.LittleEndian.PutUint32(value[8:], uint32(inheritable))
+	binary.LittleEndian.PutUint32(value[12:], uint32(permitted>>32))
+	binary.LittleEndian.PutUint32(value[16:], uint32(inheritable>>32))
+	return string(value)
+}
+
+func TestEncodeCapabilities(t *testing.T) {
+	value, err := encodeCapabilities("cap_net_bind_service=+ep")
+	assert.Nil(t, err)
+	assert.Equal(t, capabilityValue(0x02000001, 1<<10, 0), value)
+
+	value, err = encodeCapabilities("cap_net_bind_service+ep")
+	assert.Nil(t, err)
+	assert.Equal(t, capabilityValue(0x02000001, 1<<10, 0), value)
+
+	value, err = encodeCapabilities("cap_chown,CAP_KILL=pi cap_kill-i")
+	assert.Nil(t, err)
+	assert.Equal(t, capabilityValue(0x02000000, 1<<0|1<<5, 1<<0), value)
+
+	value, err = encodeCapabilities("all=p")
+	assert.Nil(t, err)
+	assert.Equal(t, capabilityValue(0x02000000, 1<<41-1, 0), value)
+
+	_, err = encodeCapabilities("cap_unknown=ep")
+	assert.EqualError(t, err, "unknown capability 'cap_unknown'")
+	_, err = encodeCapabilities("cap_kill=ex")
+	assert.EqualError(t, err, "unknown flag 'x' in the clause 'cap_kill=ex' (expected e, i or p)")
+	_, err = encodeCapabilities("cap_kill")
+	assert.EqualError(t, err, "the clause 'cap_kill' has no operator (=, + or -)")
+	_, err = encodeCapabilities(" ")
+	assert.EqualError(t, err, "no capability")
+}
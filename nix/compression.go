@@ -0,0 +1,157 @@
+package nix
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Compression is the algorithm used to compress a layer blob.
+type Compression string
+
+const (
+	CompressionNone Compression = "none"
+	CompressionGzip Compression = "gzip"
+	CompressionZstd Compression = "zstd"
+)
+
+// ParseCompression returns the Compression corresponding to its
+// name. The empty string means no compression.
+func ParseCompression(name string) (Compression, error) {
+	switch Compression(name) {
+	case "", CompressionNone:
+		return CompressionNone, nil
+	case CompressionGzip, CompressionZstd:
+		return Compression(name), nil
+	default:
+		return "", fmt.Errorf("unsupported compression %q (expected none, gzip or zstd)", name)
+	}
+}
+
+// MediaType returns the OCI layer media type of a tarball compressed
+// with this algorithm.
+func (c Compression) MediaType() string {
+	switch c {
+	case CompressionGzip:
+		return v1.MediaTypeImageLayerGzip
+	case CompressionZstd:
+		return v1.MediaTypeImageLayerZstd
+	default:
+		return v1.MediaTypeImageLayer
+	}
+}
+
+// extension returns the file extension used for layer tarballs
+// written to the disk.
+func (c Compression) extension() string {
+	switch c {
+	case CompressionGzip:
+		return ".tar.gz"
+	case CompressionZstd:
+		return ".tar.zst"
+	default:
+		return ".tar"
+	}
+}
+
+// compressionFromMediaType returns the Compression of a layer from
+// its media type.
+func compressionFromMediaType(mediaType string) Compression {
+	switch mediaType {
+	case v1.MediaTypeImageLayerGzip:
+		return CompressionGzip
+	case v1.MediaTypeImageLayerZstd:
+		return CompressionZstd
+	default:
+		return CompressionNone
+	}
+}
+
+// newCompressor returns a WriteCloser compressing everything written
+// to it into w. The returned WriteCloser has to be closed to flush
+// the compressed stream; w is not closed.
+//
+// The compressors are deterministic: all parameters are fixed (the
+// gzip header doesn't contain any name or timestamp and the zstd
+// encoder is single threaded) so that the digest of a compressed
+// reproducible layer can be computed at build time and the same bytes
+// produced again when the layer is pushed.
+func newCompressor(w io.Writer, c Compression) (io.WriteCloser, error) {
+	switch c {
+	case CompressionGzip:
+		return gzip.NewWriterLevel(w, gzip.DefaultCompression)
+	case CompressionZstd:
+		return zstd.NewWriter(w,
+			zstd.WithEncoderLevel(zstd.SpeedDefault),
+			zstd.WithEncoderConcurrency(1),
+			zstd.WithEncoderCRC(true),
+			zstd.WithZeroFrames(false),
+			zstd.WithLowerEncoderMem(false))
+	default:
+		return nopWriteCloser{w}, nil
+	}
+}
+
+// compressReader returns a ReadCloser on the compressed content of
+// reader. The reader is closed once it has been consumed or when the
+// returned ReadCloser is closed.
+func compressReader(reader io.ReadCloser, c Compression) io.ReadCloser {
+	r, w := io.Pipe()
+	go func() {
+		defer reader.Close() // nolint: errcheck
+		compressor, err := newCompressor(w, c)
+		if err != nil {
+			w.CloseWithError(err) // nolint: errcheck
+			return
+		}
+		if _, err := io.Copy(compressor, reader); err != nil {
+			w.CloseWithError(err) // nolint: errcheck
+			return
+		}
+		w.CloseWithError(compressor.Close()) // nolint: errcheck
+	}()
+	return r
+}
+
+// decompressReader returns a ReadCloser on the decompressed content
+// of reader. Closing it closes reader.
+func decompressReader(reader io.ReadCloser, c Compression) (io.ReadCloser, error) {
+	switch c {
+	case CompressionGzip:
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		return readCloser{gzipReader, func() error {
+			gzipReader.Close() // nolint: errcheck
+			return reader.Close()
+		}}, nil
+	case CompressionZstd:
+		zstdReader, err := zstd.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		return readCloser{zstdReader, func() error {
+			zstdReader.Close()
+			return reader.Close()
+		}}, nil
+	default:
+		return reader, nil
+	}
+}
+
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (r readCloser) Close() error { return r.close() }
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
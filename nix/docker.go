@@ -0,0 +1,182 @@
+package nix
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+	"go.podman.io/image/v5/docker/reference"
+)
+
+// dockerArchiveManifestItem is an element of the manifest.json file of
+// an archive produced by `docker save`.
+type dockerArchiveManifestItem struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// WriteDockerArchive writes an image to w in the format produced by
+// `docker save`, which can then be loaded by `docker load`. If repoTag
+// is not empty, the image is tagged with it.
+//
+// Layers are stored uncompressed in the archive. Since the size of a
+// tar entry has to be known before writing its content, compressed
+// layers are first decompressed to a temporary file.
+func WriteDockerArchive(image types.Image, w io.Writer, repoTag string) error {
+	var named reference.NamedTagged
+	if repoTag != "" {
+		ref, err := reference.ParseNormalizedNamed(repoTag)
+		if err != nil {
+			return fmt.Errorf("invalid image reference '%s': %w", repoTag, err)
+		}
+		var ok bool
+		named, ok = reference.TagNameOnly(ref).(reference.NamedTagged)
+		if !ok {
+			return fmt.Errorf("invalid image reference '%s': a tag is expected", repoTag)
+		}
+	}
+
+	tw := tar.NewWriter(w)
+
+	configBlob, err := GetConfigBlob(image)
+	if err != nil {
+		return err
+	}
+	configFilename := godigest.FromBytes(configBlob).Encoded() + ".json"
+	if err := writeTarEntry(tw, configFilename, bytes.NewReader(configBlob), int64(len(configBlob))); err != nil {
+		return err
+	}
+
+	var layerIDs, layerFilenames []string
+	written := make(map[string]bool)
+	for _, layer := range image.Layers {
+		diffID, err := godigest.Parse(layer.DiffIDs)
+		if err != nil {
+			return err
+		}
+		layerID := diffID.Encoded()
+		layerFilename := layerID + "/layer.tar"
+		layerIDs = append(layerIDs, layerID)
+		layerFilenames = append(layerFilenames, layerFilename)
+		if written[layerFilename] {
+			continue
+		}
+		written[layerFilename] = true
+		logrus.Infof("Writing layer %s", layer.Digest)
+		if err := writeDockerArchiveLayer(tw, layerFilename, layer, diffID); err != nil {
+			return err
+		}
+	}
+
+	item := dockerArchiveManifestItem{
+		Config:   configFilename,
+		RepoTags: []string{},
+		Layers:   layerFilenames,
+	}
+	if named != nil {
+		item.RepoTags = append(item.RepoTags, reference.FamiliarString(named))
+	}
+	manifestBlob, err := json.Marshal([]dockerArchiveManifestItem{item})
+	if err != nil {
+		return err
+	}
+	if err := writeTarEntry(tw, "manifest.json", bytes.NewReader(manifestBlob), int64(len(manifestBlob))); err != nil {
+		return err
+	}
+
+	if named != nil && len(layerIDs) > 0 {
+		repositories := map[string]map[string]string{
+			reference.FamiliarName(named): {
+				named.Tag(): layerIDs[len(layerIDs)-1],
+			},
+		}
+		repositoriesBlob, err := json.Marshal(repositories)
+		if err != nil {
+			return err
+		}
+		if err := writeTarEntry(tw, "repositories", bytes.NewReader(repositoriesBlob), int64(len(repositoriesBlob))); err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+// writeDockerArchiveLayer writes the uncompressed tarball of layer to
+// the archive and checks its digest is the layer DiffID.
+func writeDockerArchiveLayer(tw *tar.Writer, filename string, layer types.Layer, diffID godigest.Digest) error {
+	blob, _, err := LayerGetBlob(layer)
+	if err != nil {
+		return err
+	}
+	compression := compressionFromMediaType(layer.MediaType)
+	reader, err := decompressReader(blob, compression)
+	if err != nil {
+		blob.Close() // nolint: errcheck
+		return err
+	}
+	defer reader.Close() // nolint: errcheck
+
+	var size int64
+	if compression == CompressionNone {
+		descriptor, err := layerDescriptor(layer)
+		if err != nil {
+			return err
+		}
+		size = descriptor.Size
+	}
+	if size == 0 {
+		f, err := os.CreateTemp("", "nix2container-layer-")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name()) // nolint: errcheck
+		defer f.Close()           // nolint: errcheck
+		size, err = io.Copy(f, reader)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		return writeDockerArchiveLayerContent(tw, filename, f, size, diffID)
+	}
+	return writeDockerArchiveLayerContent(tw, filename, reader, size, diffID)
+}
+
+func writeDockerArchiveLayerContent(tw *tar.Writer, filename string, reader io.Reader, size int64, diffID godigest.Digest) error {
+	verifier := diffID.Verifier()
+	if err := writeTarEntry(tw, filename, io.TeeReader(reader, verifier), size); err != nil {
+		return err
+	}
+	if !verifier.Verified() {
+		return fmt.Errorf("the content of the layer '%s' doesn't match its DiffID", diffID)
+	}
+	return nil
+}
+
+func writeTarEntry(tw *tar.Writer, name string, reader io.Reader, size int64) error {
+	epoch := time.Date(1970, 01, 01, 0, 0, 0, 0, time.UTC)
+	hdr := &tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Size:     size,
+		Mode:     0644,
+		ModTime:  epoch,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("could not write hdr '%#v', got error '%s'", hdr, err.Error())
+	}
+	if _, err := io.CopyN(tw, reader, size); err != nil {
+		return fmt.Errorf("could not write '%s' to the archive, got error '%s'", name, err.Error())
+	}
+	return nil
+}
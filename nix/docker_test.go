@@ -0,0 +1,69 @@
+package nix
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteDockerArchive(t *testing.T) {
+	paths := []string{
+		"../data/layer1/file1",
+	}
+	var layers []types.Layer
+	for _, compression := range []Compression{CompressionNone, CompressionZstd} {
+		layers = append(layers, newTestLayers(t, paths, LayerOptions{Compression: compression})...)
+	}
+	image := types.Image{
+		Version: types.ImageVersion,
+		Arch:    "amd64",
+		Layers:  layers,
+	}
+
+	var buf bytes.Buffer
+	err := WriteDockerArchive(image, &buf, "hello")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	files := make(map[string][]byte)
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		files[hdr.Name] = content
+	}
+
+	var manifest []dockerArchiveManifestItem
+	assert.Nil(t, json.Unmarshal(files["manifest.json"], &manifest))
+	assert.Len(t, manifest, 1)
+	assert.Equal(t, []string{"hello:latest"}, manifest[0].RepoTags)
+
+	// Both layers have the same DiffID and are then stored once.
+	layerFilename := "cc45bd46eca903b0900ebb997dffd5778904dca9ec02e7375dd1e653dfb61e2e/layer.tar"
+	assert.Equal(t, []string{layerFilename, layerFilename}, manifest[0].Layers)
+	assert.Equal(t, layers[0].DiffIDs, godigest.FromBytes(files[layerFilename]).String())
+	assert.Len(t, files, 4)
+
+	var config v1.Image
+	assert.Nil(t, json.Unmarshal(files[manifest[0].Config], &config))
+	assert.Len(t, config.RootFS.DiffIDs, 2)
+
+	assert.JSONEq(t, `{"hello":{"latest":"cc45bd46eca903b0900ebb997dffd5778904dca9ec02e7375dd1e653dfb61e2e"}}`, string(files["repositories"]))
+}
@@ -0,0 +1,122 @@
+package nix
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/nlewo/nix2container/types"
+)
+
+// The types of an entry, with their file type bits and their default
+// mode.
+var entryTypes = map[string]struct {
+	mode        os.FileMode
+	defaultMode int64
+}{
+	"file":         {0, 0o644},
+	"directory":    {os.ModeDir, 0o755},
+	"symlink":      {os.ModeSymlink, 0o777},
+	"char-device":  {os.ModeDevice | os.ModeCharDevice, 0o666},
+	"block-device": {os.ModeDevice, 0o666},
+}
+
+// entryFileInfo describes an entry, which doesn't exist on the
+// filesystem. Its mode is used to detect collisions with other files
+// of the graph while the mode of the tar header is in perm.
+type entryFileInfo struct {
+	entry types.Entry
+	perm  int64
+}
+
+func (e entryFileInfo) Name() string { return filepath.Base(e.entry.Path) }
+func (e entryFileInfo) Size() int64  { return int64(len(e.entry.Content)) }
+func (e entryFileInfo) Mode() os.FileMode {
+	return entryTypes[e.entry.Type].mode | os.FileMode(e.perm).Perm()
+}
+func (e entryFileInfo) ModTime() time.Time { return time.Time{} }
+func (e entryFileInfo) IsDir() bool        { return e.entry.Type == "directory" }
+func (e entryFileInfo) Sys() any           { return nil }
+
+// newEntryFileInfo checks the entry and parses its mode.
+func newEntryFileInfo(entry types.Entry) (entryFileInfo, error) {
+	path := filepath.Clean(entry.Path)
+	if !filepath.IsAbs(path) || path == "/" {
+		return entryFileInfo{}, fmt.Errorf("the entry '%s' must be an absolute path other than /", entry.Path)
+	}
+	t, ok := entryTypes[entry.Type]
+	if !ok {
+		return entryFileInfo{}, fmt.Errorf("the entry '%s' has the unsupported type '%s' (expected file, directory, symlink, char-device or block-device)", entry.Path, entry.Type)
+	}
+	if entry.Type == "symlink" && entry.Target == "" {
+		return entryFileInfo{}, fmt.Errorf("the symlink entry '%s' has no target", entry.Path)
+	}
+	if entry.Type != "symlink" && entry.Target != "" {
+		return entryFileInfo{}, fmt.Errorf("the entry '%s' has a target while it is not a symlink", entry.Path)
+	}
+	if entry.Type != "file" && entry.Content != "" {
+		return entryFileInfo{}, fmt.Errorf("the entry '%s' has a content while it is not a file", entry.Path)
+	}
+	info := entryFileInfo{entry: entry, perm: t.defaultMode}
+	if entry.Mode != "" {
+		perm, err := parseOctalMode(entry.Mode)
+		if err != nil {
+			return entryFileInfo{}, fmt.Errorf("invalid mode '%s' of the entry '%s': %w", entry.Mode, entry.Path, err)
+		}
+		info.perm = perm
+	}
+	return info, nil
+}
+
+// addEntryToGraph adds an entry to the graph. Entries are added as
+// files of the Nix store and collisions are then detected by
+// addFileToGraph.
+func addEntryToGraph(root *fileNode, entry types.Entry) error {
+	entryInfo, err := newEntryFileInfo(entry)
+	if err != nil {
+		return err
+	}
+	var info os.FileInfo = entryInfo
+	return addFileToGraph(root, filepath.Clean(entry.Path), &info, &pathOptions{PathOptions: &types.PathOptions{}})
+}
+
+// appendEntryToTar writes an entry to the tar stream. Entries are
+// owned by root unless their owner is set.
+func appendEntryToTar(tw *tar.Writer, dstPath string, info entryFileInfo) error {
+	entry := info.entry
+	hdr, err := tar.FileInfoHeader(info, entry.Target)
+	if err != nil {
+		return err
+	}
+	hdr.Name = dstPath
+	hdr.Mode = info.perm
+	hdr.Devmajor = entry.Major
+	hdr.Devminor = entry.Minor
+
+	hdr.Uid = entry.Uid
+	hdr.Gid = entry.Gid
+	hdr.Uname = "root"
+	hdr.Gname = "root"
+	if entry.Uname != "" {
+		hdr.Uname = entry.Uname
+	}
+	if entry.Gname != "" {
+		hdr.Gname = entry.Gname
+	}
+
+	hdr.ModTime = time.Date(1970, 01, 01, 0, 0, 1, 0, time.UTC)
+	hdr.AccessTime = time.Date(1970, 01, 01, 0, 0, 0, 0, time.UTC)
+	hdr.ChangeTime = time.Date(1970, 01, 01, 0, 0, 0, 0, time.UTC)
+
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("could not write hdr '%#v', got error '%s'", hdr, err.Error())
+	}
+	if entry.Type == "file" {
+		if _, err := tw.Write([]byte(entry.Content)); err != nil {
+			return fmt.Errorf("could not copy the entry '%s' data to the tarball, got error '%s'", entry.Path, err.Error())
+		}
+	}
+	return nil
+}
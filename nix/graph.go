@@ -6,6 +6,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"sort"
+	"time"
 
 	"github.com/nlewo/nix2container/types"
 )
@@ -19,7 +20,7 @@ type fileNode struct {
 	// The file name on the FS
 	srcPath  string
 	info     *os.FileInfo
-	options  *types.PathOptions
+	options  *pathOptions
 	contents map[string]*fileNode
 }
 
@@ -40,14 +41,9 @@ func initGraph() *fileNode {
 // Note the graph describes the file tree of the tar stream, not the
 // file tree read on the FS. This means transformations are done during
 // the graph construction.
-func addFileToGraph(root *fileNode, path string, info *os.FileInfo, options *types.PathOptions) error {
+func addFileToGraph(root *fileNode, path string, info *os.FileInfo, options *pathOptions) error {
 
-	dstPath := path
-	if useNixCaseHack != "" {
-		dstPath = removeNixCaseHackSuffix(dstPath)
-	}
-
-	dstPath = filePathToTarPath(dstPath, options)
+	dstPath := destinationPath(path, options)
 	// A regex in the options could make the path becoming the
 	// empty string. In this case, we don't want to create
 	// anything in the graph.
@@ -58,6 +54,9 @@ func addFileToGraph(root *fileNode, path string, info *os.FileInfo, options *typ
 	parts := splitPath(dstPath)
 	current := root
 	for _, part := range parts {
+		if current.info != nil && !(*current.info).IsDir() {
+			return fmt.Errorf("the file '%s' added by '%s' is in '%s' which is not a directory", dstPath, path, current.srcPath)
+		}
 		if node, exists := current.contents[part]; exists {
 			current = node
 		} else {
@@ -68,6 +67,9 @@ func addFileToGraph(root *fileNode, path string, info *os.FileInfo, options *typ
 		}
 	}
 
+	if current.info == nil && len(current.contents) > 0 && !(*info).IsDir() {
+		return fmt.Errorf("the file '%s' added by '%s' collides with a directory of the graph", dstPath, path)
+	}
 	if current.info != nil {
 		if (*current.info).Mode() != (*info).Mode() {
 			return fmt.Errorf("the file '%s' already exists in the graph with mode '%v' from '%s' while it is added again with mode '%v' by '%s'",
@@ -92,17 +94,33 @@ func addFileToGraph(root *fileNode, path string, info *os.FileInfo, options *typ
 	return nil
 }
 
+// destinationPath returns the path of a file in the tar stream, once
+// the Nix case hack suffixes have been removed and the rewrites of
+// options have been applied.
+func destinationPath(path string, options *pathOptions) string {
+	dstPath := path
+	if useNixCaseHack != "" {
+		dstPath = removeNixCaseHackSuffix(dstPath)
+	}
+	return filePathToTarPath(dstPath, options)
+}
+
 // If info is nil, dstPath is then a directory: this directory has
 // been added to the graph but has not been walk by
 // filepath.Walk. This for instance occurs when /nix/store/storepath1
 // is added: /nix/store is not walk by the filepath.Walk function.
-type walkFunc func(srcPath, dstPath string, info *os.FileInfo, options *types.PathOptions) error
-
-func walkGraph(root *fileNode, walkFn walkFunc) error {
-	return walkGraphFn("", root, walkFn)
+// The options of such a directory contain the directory perms given
+// to walkGraph.
+type walkFunc func(srcPath, dstPath string, info *os.FileInfo, options *pathOptions) error
+
+// walkGraph walks the graph in the tar stream order. The directory
+// options, whose perms are matched against the destination path,
+// apply to the directories which have not been walk by filepath.Walk.
+func walkGraph(root *fileNode, directoryOptions *pathOptions, walkFn walkFunc) error {
+	return walkGraphFn("", root, directoryOptions, walkFn)
 }
 
-func walkGraphFn(base string, root *fileNode, walkFn walkFunc) error {
+func walkGraphFn(base string, root *fileNode, directoryOptions *pathOptions, walkFn walkFunc) error {
 	keys := make([]string, len(root.contents))
 	i := 0
 	for k := range root.contents {
@@ -119,12 +137,93 @@ func walkGraphFn(base string, root *fileNode, walkFn walkFunc) error {
 		if k == "" {
 			dstPath = filepath.Join("/", k)
 		}
-		if err := walkFn(root.contents[k].srcPath, dstPath, root.contents[k].info, root.contents[k].options); err != nil {
+		node := root.contents[k]
+		options := node.options
+		if node.info == nil {
+			options = directoryOptions
+		}
+		if err := walkFn(node.srcPath, dstPath, node.info, options); err != nil {
 			return err
 		}
-		if err := walkGraphFn(dstPath, root.contents[k], walkFn); err != nil {
+		if err := walkGraphFn(dstPath, node, directoryOptions, walkFn); err != nil {
 			return err
 		}
 	}
 	return nil
 }
+
+// The names of the files marking deletions, as described by the OCI
+// image layer specification
+const (
+	whiteoutPrefix = ".wh."
+	opaqueWhiteout = ".wh..wh..opq"
+)
+
+// whiteoutFileInfo describes a whiteout file, which doesn't exist on
+// the filesystem.
+type whiteoutFileInfo struct {
+	name string
+}
+
+func (w whiteoutFileInfo) Name() string       { return w.name }
+func (w whiteoutFileInfo) Size() int64        { return 0 }
+func (w whiteoutFileInfo) Mode() os.FileMode  { return 0 }
+func (w whiteoutFileInfo) ModTime() time.Time { return time.Time{} }
+func (w whiteoutFileInfo) IsDir() bool        { return false }
+func (w whiteoutFileInfo) Sys() any           { return nil }
+
+// addDeletionToGraph adds the whiteout file of a deletion to the
+// graph. A deleted path is marked by the .wh.<name> file in its parent
+// directory while an opaque directory contains the .wh..wh..opq file.
+//
+// Files of the graph can not be deleted by the layer containing them:
+// deletions must then be added once all files are in the graph. An
+// opaque directory can however contain files of the layer.
+func addDeletionToGraph(root *fileNode, deletion types.Deletion) error {
+	path := filepath.Clean(deletion.Path)
+	if !filepath.IsAbs(path) || path == "/" {
+		return fmt.Errorf("the deleted path '%s' must be an absolute path other than /", deletion.Path)
+	}
+	parts := splitPath(path)
+	current := root
+	for i, part := range parts[:len(parts)-1] {
+		if _, deleted := current.contents[whiteoutPrefix+part]; deleted {
+			return fmt.Errorf("the deleted path '%s' is in the deleted directory '%s'", path, filepath.Join("/", filepath.Join(parts[1:i+1]...)))
+		}
+		node, exists := current.contents[part]
+		if !exists {
+			node = &fileNode{
+				contents: make(map[string]*fileNode),
+			}
+			current.contents[part] = node
+		} else if node.info != nil && !(*node.info).IsDir() {
+			return fmt.Errorf("the deleted path '%s' is in '%s' which is not a directory", path, node.srcPath)
+		}
+		current = node
+	}
+
+	name := parts[len(parts)-1]
+	node, exists := current.contents[name]
+	if deletion.Opaque {
+		if !exists {
+			node = &fileNode{
+				contents: make(map[string]*fileNode),
+			}
+			current.contents[name] = node
+		} else if node.info != nil && !(*node.info).IsDir() {
+			return fmt.Errorf("the opaque directory '%s' collides with the file '%s' added to the layer", path, node.srcPath)
+		}
+		name, current = opaqueWhiteout, node
+	} else {
+		if exists {
+			return fmt.Errorf("the deleted path '%s' collides with files added to the layer", path)
+		}
+		name = whiteoutPrefix + name
+	}
+	var info os.FileInfo = whiteoutFileInfo{name: name}
+	current.contents[name] = &fileNode{
+		info:     &info,
+		contents: make(map[string]*fileNode),
+	}
+	return nil
+}
@@ -32,23 +32,23 @@ func TestGraph(t *testing.T) {
 
 func TestAddFileToGraphOverride(t *testing.T) {
 	g := initGraph()
-	err := addFileToGraph(g, "/nix/store/file1", nil, &types.PathOptions{
+	err := addFileToGraph(g, "/nix/store/file1", nil, &pathOptions{PathOptions: &types.PathOptions{
 		Perms: []types.Perm{
 			{
-				Regex: "*",
+				Regex: ".*",
 				Uid:   1,
 			},
 		},
-	})
+	}})
 	assert.Equal(t, nil, err)
-	err = addFileToGraph(g, "/nix/store/file1", nil, &types.PathOptions{
+	err = addFileToGraph(g, "/nix/store/file1", nil, &pathOptions{PathOptions: &types.PathOptions{
 		Perms: []types.Perm{
 			{
-				Regex: "*",
+				Regex: ".*",
 				Uid:   2,
 			},
 		},
-	})
+	}})
 	assert.Error(t, err)
 }
 
@@ -62,7 +62,7 @@ func TestWalkGraph(t *testing.T) {
 	err = addFileToGraph(g, "/nix/store/hash1", nil, nil)
 	assert.Equal(t, nil, err)
 
-	err = walkGraph(g, func(srcPath, dstPath string, info *os.FileInfo, options *types.PathOptions) error {
+	err = walkGraph(g, nil, func(srcPath, dstPath string, info *os.FileInfo, options *pathOptions) error {
 		paths[*pidx] = dstPath
 		*pidx = *pidx + 1
 		return nil
@@ -88,7 +88,7 @@ func TestWalkGraphOnDirectory(t *testing.T) {
 	missingDirectories := make([]string, 10)
 	var idx int
 	pidx := &idx
-	err = walkGraph(graph, func(srcPath, dstPath string, info *os.FileInfo, options *types.PathOptions) error {
+	err = walkGraph(graph, nil, func(srcPath, dstPath string, info *os.FileInfo, options *pathOptions) error {
 		dstPaths[*pidx] = dstPath
 		srcPaths[*pidx] = srcPath
 		if info == nil {
@@ -118,3 +118,54 @@ func TestWalkGraphOnDirectory(t *testing.T) {
 	assert.Equal(t, "../data", missingDirectories[1])
 	assert.Equal(t, "", missingDirectories[2])
 }
+
+func TestAddDeletionToGraph(t *testing.T) {
+	g := initGraph()
+	options, err := compilePathOptions(&types.PathOptions{
+		Rewrites: []types.Rewrite{{Regex: "^../data/graph-directory", Repl: "/etc"}},
+	})
+	assert.Nil(t, err)
+	err = filepath.Walk("../data/graph-directory",
+		func(path string, info os.FileInfo, err error) error {
+			return addFileToGraph(g, path, &info, options)
+		},
+	)
+	assert.Nil(t, err)
+
+	assert.Nil(t, addDeletionToGraph(g, types.Deletion{Path: "/etc/motd"}))
+	assert.Nil(t, addDeletionToGraph(g, types.Deletion{Path: "/var/cache"}))
+	// An opaque directory can contain files of the layer
+	assert.Nil(t, addDeletionToGraph(g, types.Deletion{Path: "/etc/path1", Opaque: true}))
+
+	var dstPaths []string
+	err = walkGraph(g, nil, func(srcPath, dstPath string, info *os.FileInfo, options *pathOptions) error {
+		dstPaths = append(dstPaths, dstPath)
+		return nil
+	})
+	assert.Nil(t, err)
+	expected := []string{
+		"/",
+		"/etc",
+		"/etc/.wh.motd",
+		"/etc/path1",
+		"/etc/path1/.wh..wh..opq",
+		"/etc/path1/path11",
+		"/etc/path1/path11/file111",
+		"/etc/path2",
+		"/etc/path2/file21",
+		"/var",
+		"/var/.wh.cache",
+	}
+	assert.Equal(t, expected, dstPaths)
+
+	err = addDeletionToGraph(g, types.Deletion{Path: "/etc/path2/file21"})
+	assert.EqualError(t, err, "the deleted path '/etc/path2/file21' collides with files added to the layer")
+	err = addDeletionToGraph(g, types.Deletion{Path: "/etc/path2/file21/file"})
+	assert.EqualError(t, err, "the deleted path '/etc/path2/file21/file' is in '../data/graph-directory/path2/file21' which is not a directory")
+	err = addDeletionToGraph(g, types.Deletion{Path: "/etc/path2/file21", Opaque: true})
+	assert.EqualError(t, err, "the opaque directory '/etc/path2/file21' collides with the file '../data/graph-directory/path2/file21' added to the layer")
+	err = addDeletionToGraph(g, types.Deletion{Path: "/var/cache/apk"})
+	assert.EqualError(t, err, "the deleted path '/var/cache/apk' is in the deleted directory '/var/cache'")
+	err = addDeletionToGraph(g, types.Deletion{Path: "etc"})
+	assert.EqualError(t, err, "the deleted path 'etc' must be an absolute path other than /")
+}
@@ -47,6 +47,56 @@ func GetConfigDigest(image types.Image) (d godigest.Digest, size int64, err erro
 	return d, int64(len(configBlob)), err
 }
 
+// GetManifest returns the OCI manifest of an image.
+func GetManifest(image types.Image) ([]byte, error) {
+	configDigest, configSize, err := GetConfigDigest(image)
+	if err != nil {
+		return nil, err
+	}
+	m := v1.Manifest{
+		MediaType: v1.MediaTypeImageManifest,
+		Config: v1.Descriptor{
+			MediaType: v1.MediaTypeImageConfig,
+			Digest:    configDigest,
+			Size:      configSize,
+		},
+		Layers: []v1.Descriptor{},
+	}
+	m.SchemaVersion = 2
+	for _, layer := range image.Layers {
+		descriptor, err := layerDescriptor(layer)
+		if err != nil {
+			return nil, err
+		}
+		m.Layers = append(m.Layers, descriptor)
+	}
+	return json.Marshal(m)
+}
+
+// layerDescriptor returns the descriptor of a layer blob. Layers
+// coming from a tarball, such as layers of images built with
+// NewImageFromDir, don't always have a size: it is then the size of
+// the tarball.
+func layerDescriptor(layer types.Layer) (v1.Descriptor, error) {
+	digest, err := godigest.Parse(layer.Digest)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	size := layer.Size
+	if size == 0 && layer.LayerPath != "" {
+		info, err := os.Stat(layer.LayerPath)
+		if err != nil {
+			return v1.Descriptor{}, err
+		}
+		size = info.Size()
+	}
+	return v1.Descriptor{
+		MediaType: layer.MediaType,
+		Digest:    digest,
+		Size:      size,
+	}, nil
+}
+
 // GetBlob gets the layer corresponding to the provided digest.
 func GetBlob(image types.Image, digest godigest.Digest) (io.ReadCloser, int64, error) {
 	for _, layer := range image.Layers {
@@ -69,9 +119,19 @@ func GetBlob(image types.Image, digest godigest.Digest) (io.ReadCloser, int64, e
 	return nil, 0, errors.New("no blob with specified digest found in image")
 }
 
+// getPlatform returns the platform an image runs on.
+func getPlatform(image types.Image) v1.Platform {
+	return v1.Platform{
+		OS:           "linux",
+		Architecture: image.Arch,
+		Variant:      image.Variant,
+		OSVersion:    image.OSVersion,
+		OSFeatures:   image.OSFeatures,
+	}
+}
+
 func getV1Image(image types.Image) (imageV1 v1.Image, err error) {
-	imageV1.OS = "linux"
-	imageV1.Architecture = image.Arch
+	imageV1.Platform = getPlatform(image)
 	imageV1.Config = image.ImageConfig
 	imageV1.Created = image.Created
 
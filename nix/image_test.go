@@ -64,3 +64,21 @@ func TestGetV1Image(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, v1Image, expected)
 }
+
+func TestGetV1ImagePlatform(t *testing.T) {
+	image := types.Image{
+		Arch:       "arm",
+		Variant:    "v7",
+		OSVersion:  "6.1",
+		OSFeatures: []string{"feature"},
+	}
+	v1Image, err := getV1Image(image)
+	assert.Nil(t, err)
+	assert.Equal(t, v1.Platform{
+		OS:           "linux",
+		Architecture: "arm",
+		Variant:      "v7",
+		OSVersion:    "6.1",
+		OSFeatures:   []string{"feature"},
+	}, v1Image.Platform)
+}
@@ -0,0 +1,96 @@
+package nix
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// NewImageIndex builds an ImageIndex from images built for different
+// platforms. Two images can not have the same platform.
+func NewImageIndex(images []types.Image) (index types.ImageIndex, err error) {
+	index.Version = types.ImageVersion
+	platforms := make(map[string]bool)
+	for _, image := range images {
+		platform := getPlatform(image)
+		if err := ValidatePlatform(platform); err != nil {
+			return index, err
+		}
+		key := platformString(platform)
+		if platforms[key] {
+			return index, fmt.Errorf("several images are built for the platform %s", key)
+		}
+		platforms[key] = true
+		index.Images = append(index.Images, image)
+	}
+	return index, nil
+}
+
+// NewImageIndexFromFile creates an ImageIndex from a JSON file
+// created by the nix2container index command.
+func NewImageIndexFromFile(filename string) (index types.ImageIndex, err error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return index, err
+	}
+	err = json.Unmarshal(content, &index)
+	if err != nil {
+		return index, err
+	}
+	if index.Images == nil {
+		return index, fmt.Errorf("the file %s doesn't describe an image index", filename)
+	}
+	return index, nil
+}
+
+// IsImageIndexFile returns true if filename describes an ImageIndex
+// instead of an Image.
+func IsImageIndexFile(filename string) (bool, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return false, err
+	}
+	var probe struct {
+		Images json.RawMessage `json:"images"`
+	}
+	if err := json.Unmarshal(content, &probe); err != nil {
+		return false, err
+	}
+	return probe.Images != nil, nil
+}
+
+// GetIndexManifest returns the OCI image index referencing the
+// manifests of all images of index, with their platform.
+func GetIndexManifest(index types.ImageIndex) ([]byte, error) {
+	i := v1.Index{
+		MediaType: v1.MediaTypeImageIndex,
+		Manifests: []v1.Descriptor{},
+	}
+	i.SchemaVersion = 2
+	for _, image := range index.Images {
+		manifest, err := GetManifest(image)
+		if err != nil {
+			return nil, err
+		}
+		platform := getPlatform(image)
+		i.Manifests = append(i.Manifests, v1.Descriptor{
+			MediaType: v1.MediaTypeImageManifest,
+			Digest:    godigest.FromBytes(manifest),
+			Size:      int64(len(manifest)),
+			Platform:  &platform,
+		})
+	}
+	return json.Marshal(i)
+}
+
+func platformString(platform v1.Platform) string {
+	s := platform.OS + "/" + platform.Architecture
+	if platform.Variant != "" {
+		s += "/" + platform.Variant
+	}
+	return s
+}
@@ -0,0 +1,78 @@
+package nix
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func testImageIndex(t *testing.T) types.ImageIndex {
+	paths := []string{
+		"../data/layer1/file1",
+	}
+	layers := newTestLayers(t, paths, LayerOptions{})
+	index, err := NewImageIndex([]types.Image{
+		{Version: types.ImageVersion, Arch: "amd64", Layers: layers},
+		{Version: types.ImageVersion, Arch: "arm64", Layers: layers},
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return index
+}
+
+func TestNewImageIndex(t *testing.T) {
+	_, err := NewImageIndex([]types.Image{
+		{Arch: "amd64"},
+		{Arch: "amd64"},
+	})
+	assert.Error(t, err)
+}
+
+func TestGetIndexManifest(t *testing.T) {
+	index := testImageIndex(t)
+	blob, err := GetIndexManifest(index)
+	assert.Nil(t, err)
+	var i v1.Index
+	assert.Nil(t, json.Unmarshal(blob, &i))
+	assert.Equal(t, v1.MediaTypeImageIndex, i.MediaType)
+	assert.Len(t, i.Manifests, 2)
+	for n, image := range index.Images {
+		manifest, err := GetManifest(image)
+		assert.Nil(t, err)
+		assert.Equal(t, godigest.FromBytes(manifest), i.Manifests[n].Digest)
+		assert.Equal(t, &v1.Platform{OS: "linux", Architecture: image.Arch}, i.Manifests[n].Platform)
+	}
+}
+
+func TestWriteOCILayoutImageIndex(t *testing.T) {
+	index := testImageIndex(t)
+	directory := t.TempDir()
+	err := WriteOCILayoutImageIndex(index, directory)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	var layoutIndex v1.Index
+	content, err := os.ReadFile(filepath.Join(directory, "index.json"))
+	assert.Nil(t, err)
+	assert.Nil(t, json.Unmarshal(content, &layoutIndex))
+	assert.Len(t, layoutIndex.Manifests, 1)
+	assert.Equal(t, v1.MediaTypeImageIndex, layoutIndex.Manifests[0].MediaType)
+
+	indexBlob, err := GetIndexManifest(index)
+	assert.Nil(t, err)
+	assert.Equal(t, godigest.FromBytes(indexBlob), layoutIndex.Manifests[0].Digest)
+
+	// The shared layer, the image index, and a config and a
+	// manifest per image
+	entries, err := os.ReadDir(filepath.Join(directory, "blobs", "sha256"))
+	assert.Nil(t, err)
+	assert.Len(t, entries, 6)
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package nix
+
+import (
+	"os"
+)
+
+// getFileID always returns false since hard links are not detected
+// on this platform.
+func getFileID(info os.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
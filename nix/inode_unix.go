@@ -0,0 +1,18 @@
+//go:build unix
+
+package nix
+
+import (
+	"os"
+	"syscall"
+)
+
+// getFileID returns the device and inode numbers of a file having
+// several hard links.
+func getFileID(info os.FileInfo) (fileID, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || stat.Nlink <= 1 {
+		return fileID{}, false
+	}
+	return fileID{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}, true
+}
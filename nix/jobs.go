@@ -0,0 +1,59 @@
+package nix
+
+import (
+	"context"
+	"errors"
+	"runtime"
+	"sync"
+)
+
+// runJobs calls fn with the indexes from 0 to n-1, with at most jobs
+// concurrent calls, or one call per CPU if jobs is 0. Once a call
+// returns an error, the remaining indexes are not processed and the
+// context given to the running calls is canceled: the error of the
+// lowest failed index, which has not been canceled, is then returned.
+func runJobs(n, jobs int, fn func(ctx context.Context, i int) error) error {
+	if jobs <= 0 {
+		jobs = runtime.NumCPU()
+	}
+	jobs = min(jobs, n)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	errs := make([]error, n)
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for range jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if errs[i] = fn(ctx, i); errs[i] != nil {
+					cancel()
+				}
+			}
+		}()
+	}
+feed:
+	for i := range n {
+		select {
+		case indexes <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	var canceled error
+	for _, err := range errs {
+		if errors.Is(err, context.Canceled) {
+			if canceled == nil {
+				canceled = err
+			}
+		} else if err != nil {
+			return err
+		}
+	}
+	return canceled
+}
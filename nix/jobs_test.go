@@ -0,0 +1,56 @@
+package nix
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRunJobs(t *testing.T) {
+	var running, maxRunning atomic.Int32
+	results := make([]int, 20)
+	err := runJobs(len(results), 4, func(ctx context.Context, i int) error {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for {
+			m := maxRunning.Load()
+			if n <= m || maxRunning.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		results[i] = i * i
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.LessOrEqual(t, maxRunning.Load(), int32(4))
+	for i, r := range results {
+		assert.Equal(t, i*i, r)
+	}
+
+	// An error prevents the remaining indexes from being processed
+	var processed atomic.Int32
+	err = runJobs(100, 2, func(ctx context.Context, i int) error {
+		processed.Add(1)
+		if i == 3 {
+			return fmt.Errorf("job %d failed", i)
+		}
+		return nil
+	})
+	assert.EqualError(t, err, "job 3 failed")
+	assert.Less(t, processed.Load(), int32(100))
+
+	// The running calls are canceled and their error is not returned
+	err = runJobs(2, 2, func(ctx context.Context, i int) error {
+		if i == 1 {
+			return fmt.Errorf("job %d failed", i)
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	assert.EqualError(t, err, "job 1 failed")
+}
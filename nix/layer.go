@@ -7,13 +7,19 @@ import (
 	"github.com/nlewo/nix2container/types"
 )
 
+// LayerGetBlob returns a reader on the layer blob. When the layer is
+// built from store paths, the tar stream is compressed according to
+// the layer media type.
 func LayerGetBlob(layer types.Layer) (reader io.ReadCloser, size int64, err error) {
 	if layer.LayerPath != "" {
 		reader, err = os.Open(layer.LayerPath)
 		return
 	}
-	if layer.Paths != nil {
-		reader = TarPaths(layer.Paths)
+	if layer.Paths != nil || layer.Entries != nil || layer.Deletions != nil {
+		reader = TarPaths(layer.Paths, layer.Entries, layer.Deletions, layer.DirectoryPerms, layer.HardLinks)
+		if compression := compressionFromMediaType(layer.MediaType); compression != CompressionNone {
+			reader = compressReader(reader, compression)
+		}
 		return
 	}
 	return reader, layer.Size, err
@@ -0,0 +1,226 @@
+package nix
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/nlewo/nix2container/types"
+	"github.com/sirupsen/logrus"
+)
+
+// PathInfo holds the closure graph metadata of a store path.
+type PathInfo struct {
+	// The number of paths of the closure graph going through this
+	// store path
+	Popularity int64
+	// The size of the NAR serialisation of the store path, in bytes
+	NarSize int64
+}
+
+// LayeringStrategy groups store paths in layers. Paths are sorted
+// by popularity and infos holds the closure graph metadata of the
+// store paths, which can be missing. A strategy returns at most
+// maxLayers groups, each of them becoming a layer.
+type LayeringStrategy interface {
+	Group(paths types.Paths, infos map[string]PathInfo, maxLayers int) []types.Paths
+}
+
+// PopularityStrategy isolates the most popular store paths, as
+// described in
+// https://grahamc.com/blog/nix-and-layered-docker-images
+type PopularityStrategy struct{}
+
+func (PopularityStrategy) Group(paths types.Paths, infos map[string]PathInfo, maxLayers int) []types.Paths {
+	return groupPathsByPopularity(paths, maxLayers)
+}
+
+// SizeStrategy creates layers of similar sizes by using the narSize
+// of the store paths (see groupPathsBySize).
+type SizeStrategy struct{}
+
+func (SizeStrategy) Group(paths types.Paths, infos map[string]PathInfo, maxLayers int) []types.Paths {
+	return groupPathsBySize(paths, infos, maxLayers)
+}
+
+// layeringStrategies are the strategies selectable by name.
+var layeringStrategies = map[string]LayeringStrategy{
+	"popularity": PopularityStrategy{},
+	"size":       SizeStrategy{},
+}
+
+// ParseLayeringStrategy returns the LayeringStrategy corresponding to
+// its name. The empty string means the popularity strategy.
+func ParseLayeringStrategy(name string) (LayeringStrategy, error) {
+	if name == "" {
+		return PopularityStrategy{}, nil
+	}
+	strategy, ok := layeringStrategies[name]
+	if !ok {
+		names := make([]string, 0, len(layeringStrategies))
+		for n := range layeringStrategies {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unsupported layering strategy %q (expected %s)", name, strings.Join(names, " or "))
+	}
+	return strategy, nil
+}
+
+// groupPathsByName puts each path matching the regex of one of
+// layerGroups in the group of this layer, the first matching layer
+// group winning. It returns the groups containing at least one path,
+// their names and the paths not matching any layer group, in their
+// original order.
+func groupPathsByName(paths types.Paths, layerGroups []types.LayerGroup) (groups []types.Paths, names []string, rest types.Paths, err error) {
+	regexes := make([]*regexp.Regexp, len(layerGroups))
+	for i, layerGroup := range layerGroups {
+		if layerGroup.Name == "" {
+			return nil, nil, nil, fmt.Errorf("the layer group with the regex '%s' has no name", layerGroup.Regex)
+		}
+		regexes[i], err = regexp.Compile(layerGroup.Regex)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("invalid regex of the layer group '%s': %w", layerGroup.Name, err)
+		}
+	}
+	matched := make([]types.Paths, len(layerGroups))
+	for _, p := range paths {
+		found := false
+		for i, re := range regexes {
+			if re.MatchString(p.Path) {
+				matched[i] = append(matched[i], p)
+				found = true
+				break
+			}
+		}
+		if !found {
+			rest = append(rest, p)
+		}
+	}
+	for i, group := range matched {
+		if len(group) == 0 {
+			logrus.Infof("No store path matches the layer group '%s'", layerGroups[i].Name)
+			continue
+		}
+		groups = append(groups, group)
+		names = append(names, layerGroups[i].Name)
+	}
+	return groups, names, rest, nil
+}
+
+// groupPathsByPopularity puts each of the first maxLayers-1 paths
+// in its own layer and all remaining paths in the last layer. Paths
+// are expected to be sorted by popularity.
+func groupPathsByPopularity(paths types.Paths, maxLayers int) (groups []types.Paths) {
+	offset := 0
+	for offset < len(paths) {
+		max := offset + 1
+		if offset == maxLayers-1 {
+			max = len(paths)
+		}
+		groups = append(groups, paths[offset:max])
+		offset = max
+	}
+	return groups
+}
+
+// groupPathsBySize groups paths, sorted by popularity, in at most
+// maxLayers layers of similar sizes:
+//
+//   - a path bigger than the average layer size is isolated in its own
+//     layer, the biggest and most popular paths first;
+//   - the remaining paths are packed, in popularity order, into the
+//     remaining layers, each of them holding about the same amount of
+//     bytes but at least half of the average layer size. Small
+//     popular paths are then merged together and the least popular
+//     paths end up in the last layers.
+//
+// If the sizes of the paths are unknown, paths are grouped by
+// popularity only.
+func groupPathsBySize(paths types.Paths, infos map[string]PathInfo, maxLayers int) []types.Paths {
+	var total int64
+	for _, p := range paths {
+		total += infos[p.Path].NarSize
+	}
+	if maxLayers <= 1 || total == 0 {
+		return groupPathsByPopularity(paths, maxLayers)
+	}
+
+	// Huge paths are isolated, by decreasing popularity * size:
+	// this is an estimate of the amount of bytes saved by not
+	// having to pull them again when another path changes.
+	average := total / int64(maxLayers)
+	var huge []int
+	for i, p := range paths {
+		if infos[p.Path].NarSize >= average {
+			huge = append(huge, i)
+		}
+	}
+	sort.SliceStable(huge, func(i, j int) bool {
+		a, b := infos[paths[huge[i]].Path], infos[paths[huge[j]].Path]
+		return a.Popularity*a.NarSize > b.Popularity*b.NarSize
+	})
+	if len(huge) > maxLayers-1 {
+		huge = huge[:maxLayers-1]
+	}
+	isolated := make(map[int]bool, len(huge))
+	for _, i := range huge {
+		isolated[i] = true
+	}
+
+	// Groups are indexed by the position of their first path, in
+	// order to keep layers sorted by popularity.
+	type group struct {
+		first int
+		paths types.Paths
+	}
+	var groups []group
+	var remaining int64
+	for i, p := range paths {
+		if isolated[i] {
+			groups = append(groups, group{first: i, paths: types.Paths{p}})
+		} else {
+			remaining += infos[p.Path].NarSize
+		}
+	}
+
+	budget := maxLayers - len(huge)
+	current := -1
+	var currentSize int64
+	for i, p := range paths {
+		if isolated[i] {
+			continue
+		}
+		if current == -1 {
+			groups = append(groups, group{first: i})
+			current = len(groups) - 1
+			currentSize = 0
+		}
+		size := infos[p.Path].NarSize
+		groups[current].paths = append(groups[current].paths, p)
+		currentSize += size
+		remaining -= size
+		// The target size is computed again for each group
+		// to spread the remaining paths over the remaining
+		// layers. A group is never smaller than half of the
+		// average layer size to avoid creating tiny layers.
+		target := (currentSize + remaining) / int64(budget)
+		if target < average/2 {
+			target = average / 2
+		}
+		if budget > 1 && currentSize >= target {
+			current = -1
+			budget--
+		}
+	}
+
+	sort.SliceStable(groups, func(i, j int) bool {
+		return groups[i].first < groups[j].first
+	})
+	res := make([]types.Paths, len(groups))
+	for i, g := range groups {
+		res[i] = g.paths
+	}
+	return res
+}
@@ -0,0 +1,126 @@
+package nix
+
+import (
+	"testing"
+
+	"github.com/nlewo/nix2container/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func testPaths(names ...string) (paths types.Paths) {
+	for _, name := range names {
+		paths = append(paths, types.Path{Path: name})
+	}
+	return paths
+}
+
+func TestGroupPathsByPopularity(t *testing.T) {
+	paths := testPaths("A", "B", "C", "D")
+	assert.Equal(t, []types.Paths{testPaths("A", "B", "C", "D")}, groupPathsByPopularity(paths, 1))
+	assert.Equal(t, []types.Paths{testPaths("A"), testPaths("B", "C", "D")}, groupPathsByPopularity(paths, 2))
+	assert.Equal(t, []types.Paths{testPaths("A"), testPaths("B"), testPaths("C"), testPaths("D")}, groupPathsByPopularity(paths, 10))
+}
+
+func TestGroupPathsBySize(t *testing.T) {
+	paths := testPaths("A", "B", "C", "D", "E", "F")
+	infos := map[string]PathInfo{
+		"A": {Popularity: 6, NarSize: 10},
+		"B": {Popularity: 5, NarSize: 10},
+		"C": {Popularity: 4, NarSize: 2000},
+		"D": {Popularity: 3, NarSize: 10},
+		"E": {Popularity: 2, NarSize: 10},
+		"F": {Popularity: 1, NarSize: 10},
+	}
+	// C is isolated and small paths, much smaller than the
+	// average layer size, are merged together
+	expected := []types.Paths{testPaths("A", "B", "D", "E", "F"), testPaths("C")}
+	assert.Equal(t, expected, groupPathsBySize(paths, infos, 3))
+
+	// With a bigger budget, the average layer size is smaller
+	// and small paths are spread over several layers
+	expected = []types.Paths{testPaths("A", "B", "D"), testPaths("C"), testPaths("E", "F")}
+	assert.Equal(t, expected, groupPathsBySize(paths, infos, 40))
+
+	// When there are more huge paths than layers, the most
+	// popular ones are isolated first
+	infos = map[string]PathInfo{
+		"C": {Popularity: 4, NarSize: 1000},
+		"F": {Popularity: 1, NarSize: 1000},
+	}
+	expected = []types.Paths{testPaths("A", "B", "D", "E", "F"), testPaths("C")}
+	assert.Equal(t, expected, groupPathsBySize(paths, infos, 2))
+
+	// Without sizes, paths are grouped by popularity
+	assert.Equal(t, groupPathsByPopularity(paths, 3), groupPathsBySize(paths, map[string]PathInfo{}, 3))
+}
+
+func TestParseLayeringStrategy(t *testing.T) {
+	strategy, err := ParseLayeringStrategy("")
+	assert.Nil(t, err)
+	assert.Equal(t, PopularityStrategy{}, strategy)
+	strategy, err = ParseLayeringStrategy("size")
+	assert.Nil(t, err)
+	assert.Equal(t, SizeStrategy{}, strategy)
+	_, err = ParseLayeringStrategy("random")
+	assert.EqualError(t, err, `unsupported layering strategy "random" (expected popularity or size)`)
+}
+
+// reverseStrategy puts each path in its own layer, least popular
+// first.
+type reverseStrategy struct{}
+
+func (reverseStrategy) Group(paths types.Paths, infos map[string]PathInfo, maxLayers int) (groups []types.Paths) {
+	for i := len(paths) - 1; i >= 0; i-- {
+		groups = append(groups, paths[i:i+1])
+	}
+	return groups
+}
+
+func TestGroupPaths(t *testing.T) {
+	paths := testPaths("A", "B", "C")
+	groups, names, _, err := groupPaths(paths, nil, nil, nil, 2, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, groupPathsByPopularity(paths, 2), groups)
+	assert.Equal(t, []string{"", ""}, names)
+
+	groups, _, _, err = groupPaths(paths, nil, reverseStrategy{}, nil, 2, nil)
+	assert.Nil(t, err)
+	expected := []types.Paths{testPaths("C"), testPaths("B"), testPaths("A")}
+	assert.Equal(t, expected, groups)
+
+	layerGroups := []types.LayerGroup{{Name: "c", Regex: "C"}}
+	groups, names, _, err = groupPaths(paths, layerGroups, reverseStrategy{}, nil, 2, nil)
+	assert.Nil(t, err)
+	expected = []types.Paths{testPaths("C"), testPaths("B"), testPaths("A")}
+	assert.Equal(t, expected, groups)
+	assert.Equal(t, []string{"c", "", ""}, names)
+}
+
+func TestGroupPathsByName(t *testing.T) {
+	paths := testPaths(
+		"/nix/store/aaa-python3.11-requests",
+		"/nix/store/bbb-glibc-2.38",
+		"/nix/store/ccc-bash",
+		"/nix/store/ddd-python3.11",
+		"/nix/store/eee-gcc-13.2.0-lib",
+	)
+	layerGroups := []types.LayerGroup{
+		{Name: "python", Regex: `-python3\.[0-9]+`},
+		{Name: "libc", Regex: `-(glibc-|gcc-.*-lib$)`},
+		{Name: "empty", Regex: `-perl-`},
+	}
+	groups, names, rest, err := groupPathsByName(paths, layerGroups)
+	assert.Nil(t, err)
+	expected := []types.Paths{
+		testPaths("/nix/store/aaa-python3.11-requests", "/nix/store/ddd-python3.11"),
+		testPaths("/nix/store/bbb-glibc-2.38", "/nix/store/eee-gcc-13.2.0-lib"),
+	}
+	assert.Equal(t, expected, groups)
+	assert.Equal(t, []string{"python", "libc"}, names)
+	assert.Equal(t, testPaths("/nix/store/ccc-bash"), rest)
+
+	_, _, _, err = groupPathsByName(paths, []types.LayerGroup{{Name: "invalid", Regex: "("}})
+	assert.ErrorContains(t, err, "invalid regex of the layer group 'invalid'")
+	_, _, _, err = groupPathsByName(paths, []types.LayerGroup{{Regex: "python"}})
+	assert.EqualError(t, err, "the layer group with the regex 'python' has no name")
+}
@@ -1,8 +1,11 @@
 package nix
 
 import (
+	"context"
 	_ "crypto/sha256"
 	_ "crypto/sha512"
+	"fmt"
+	"os"
 	"reflect"
 
 	"github.com/nlewo/nix2container/types"
@@ -11,7 +14,25 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-func getPaths(storePaths []string, parents []types.Layer, rewrites []types.RewritePath, exclude string, permPaths []types.PermPath) types.Paths {
+// permOf returns the perm of a perm path.
+func permOf(perm types.PermPath) types.Perm {
+	return types.Perm{
+		Regex:  perm.Regex,
+		Mode:   perm.Mode,
+		Uid:    perm.Uid,
+		Gid:    perm.Gid,
+		Uname:  perm.Uname,
+		Gname:  perm.Gname,
+		Xattrs: perm.Xattrs,
+		Match:  perm.Match,
+		Type:   perm.Type,
+	}
+}
+
+// getPaths builds the paths of storePaths with their perms and their
+// rewrites, which are applied in order. Several rewrites of a path
+// with the same regex are an error.
+func getPaths(storePaths []string, parents []types.Layer, rewrites []types.RewritePath, exclude string, permPaths []types.PermPath) (types.Paths, error) {
 	var paths types.Paths
 	for _, p := range storePaths {
 		path := types.Path{
@@ -23,14 +44,7 @@ func getPaths(storePaths []string, parents []types.Layer, rewrites []types.Rewri
 		for _, perm := range permPaths {
 			if p == perm.Path {
 				hasPathOptions = true
-				perms = append(perms, types.Perm{
-					Regex: perm.Regex,
-					Mode:  perm.Mode,
-					Uid:   perm.Uid,
-					Gid:   perm.Gid,
-					Uname: perm.Uname,
-					Gname: perm.Gname,
-				})
+				perms = append(perms, permOf(perm))
 			}
 		}
 		if perms != nil {
@@ -38,11 +52,16 @@ func getPaths(storePaths []string, parents []types.Layer, rewrites []types.Rewri
 		}
 		for _, rewrite := range rewrites {
 			if p == rewrite.Path {
+				for _, r := range pathOptions.Rewrites {
+					if r.Regex == rewrite.Regex {
+						return nil, fmt.Errorf("the path '%s' has several rewrites of the regex '%s'", p, rewrite.Regex)
+					}
+				}
 				hasPathOptions = true
-				pathOptions.Rewrite = types.Rewrite{
+				pathOptions.Rewrites = append(pathOptions.Rewrites, types.Rewrite{
 					Regex: rewrite.Regex,
 					Repl:  rewrite.Repl,
-				}
+				})
 			}
 		}
 		if hasPathOptions {
@@ -58,69 +77,254 @@ func getPaths(storePaths []string, parents []types.Layer, rewrites []types.Rewri
 		}
 		paths = append(paths, path)
 	}
-	return paths
+	return paths, nil
 }
 
 // If tarDirectory is not an empty string, the tar layer is written to
 // the disk. This is useful for layer containing non reproducible
-// store paths.
-func newLayers(paths types.Paths, tarDirectory string, maxLayers int, history v1.History) (layers []types.Layer, err error) {
-	offset := 0
-	for offset < len(paths) {
-		max := offset + 1
-		if offset == maxLayers-1 {
-			max = len(paths)
-		}
-		layerPaths := paths[offset:max]
+// store paths. Layer blobs are compressed with compression. If the
+// name of a group is not empty, it is used as the history comment of
+// its layers. If maxLayerSize is not 0, groups whose layer is bigger
+// than maxLayerSize are split in several layers (see splitPaths).
+// Entries and deletions are added to the first layer, which is
+// created if there is no group. The directory perms apply to the
+// directories which are not in the Nix store of all layers. If
+// hardLinks is true, hard links are preserved. The digests of layers
+// which are not written to the disk are read from cache, if not nil.
+// The layers of at most jobs groups are built concurrently (see
+// runJobs) and returned in the order of the groups. The popularity of
+// the layers is computed from infos (see pathsPopularity).
+func newLayers(groups []types.Paths, names []string, infos map[string]PathInfo, entries []types.Entry, deletions []types.Deletion, directoryPerms []types.Perm, hardLinks bool, tarDirectory string, history v1.History, compression Compression, maxLayerSize int64, cache *DigestCache, jobs int) ([]types.Layer, error) {
+	if len(groups) == 0 && (len(entries) > 0 || len(deletions) > 0) {
+		groups = []types.Paths{nil}
+		names = []string{""}
+	}
+	groupLayers := make([][]types.Layer, len(groups))
+	err := runJobs(len(groups), jobs, func(ctx context.Context, i int) (err error) {
+		var groupEntries []types.Entry
+		var groupDeletions []types.Deletion
+		if i == 0 {
+			groupEntries, groupDeletions = entries, deletions
+		}
+		groupLayers[i], err = newGroupLayers(ctx, groups[i], names[i], groupEntries, groupDeletions, directoryPerms, hardLinks, tarDirectory, history, compression, maxLayerSize, cache)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var layers []types.Layer
+	for _, l := range groupLayers {
+		layers = append(layers, l...)
+	}
+	for i := range layers {
+		layers[i].Popularity = pathsPopularity(layers[i].Paths, infos)
+	}
+	return layers, nil
+}
+
+// pathsPopularity returns the sum of the popularity of the store paths
+// of paths. A split store path is only counted once.
+func pathsPopularity(paths types.Paths, infos map[string]PathInfo) (popularity int64) {
+	seen := make(map[string]bool)
+	for _, p := range paths {
+		storePath := p.Path
+		if p.SplitFrom != "" {
+			storePath = p.SplitFrom
+		}
+		if !seen[storePath] {
+			seen[storePath] = true
+			popularity += infos[storePath].Popularity
+		}
+	}
+	return popularity
+}
+
+// newGroupLayers builds the layers of a group, which is split if its
+// layer is bigger than maxLayerSize. Entries and deletions are added
+// to its first layer. The layers are not built anymore once ctx is
+// done.
+func newGroupLayers(ctx context.Context, group types.Paths, name string, entries []types.Entry, deletions []types.Deletion, directoryPerms []types.Perm, hardLinks bool, tarDirectory string, history v1.History, compression Compression, maxLayerSize int64, cache *DigestCache) (layers []types.Layer, err error) {
+	pending := []types.Paths{group}
+	for len(pending) > 0 {
+		layerPaths := pending[0]
+		pending = pending[1:]
+
+		layerEntries := entries
+		layerDeletions := deletions
 		layerPath := ""
-		var digest godigest.Digest
+		var digest, diffID godigest.Digest
 		var size int64
 		if tarDirectory == "" {
-			digest, size, err = TarPathsSum(layerPaths)
+			digest, diffID, size, err = cache.TarPathsSum(ctx, layerPaths, layerEntries, layerDeletions, directoryPerms, hardLinks, compression)
 		} else {
-			layerPath, digest, size, err = TarPathsWrite(paths, tarDirectory)
+			layerPath, digest, diffID, size, err = tarPathsWrite(ctx, layerPaths, layerEntries, layerDeletions, directoryPerms, hardLinks, tarDirectory, compression)
 		}
 		if err != nil {
 			return layers, err
 		}
+		if maxLayerSize > 0 && size > maxLayerSize {
+			logrus.Infof("Splitting the layer of %d paths (size:%d) since it is bigger than %d bytes", len(layerPaths), size, maxLayerSize)
+			if layerPath != "" {
+				if err := os.Remove(layerPath); err != nil {
+					return layers, err
+				}
+			}
+			split, err := splitPaths(layerPaths, size, maxLayerSize)
+			if err != nil {
+				return layers, err
+			}
+			pending = append(split, pending...)
+			continue
+		}
+		if tarDirectory == "" {
+			if err := cache.Add(layerPaths, layerEntries, layerDeletions, directoryPerms, hardLinks, compression, digest, diffID, size); err != nil {
+				return layers, err
+			}
+		}
 		logrus.Infof("Adding %d paths to layer (size:%d digest:%s)", len(layerPaths), size, digest.String())
 		layer := types.Layer{
-			Digest:    digest.String(),
-			DiffIDs:   digest.String(),
-			Size:      size,
-			Paths:     layerPaths,
-			MediaType: v1.MediaTypeImageLayer,
-			History:   history,
+			Digest:         digest.String(),
+			DiffIDs:        diffID.String(),
+			Size:           size,
+			Paths:          layerPaths,
+			Entries:        layerEntries,
+			Deletions:      layerDeletions,
+			DirectoryPerms: directoryPerms,
+			HardLinks:      hardLinks,
+			MediaType:      compression.MediaType(),
+			History:        history,
+		}
+		entries = nil
+		deletions = nil
+		if name != "" {
+			layer.History.Comment = name
 		}
 		if tarDirectory != "" {
-			// TODO: we should use v1.MediaTypeImageLayerGzip instead
-			layer.MediaType = v1.MediaTypeImageLayer
 			layer.LayerPath = layerPath
 		}
 
 		layers = append(layers, layer)
-
-		offset = max
 	}
 	return layers, nil
 }
 
-func NewLayers(storePaths []string, maxLayers int, parents []types.Layer, rewrites []types.RewritePath, exclude string, perms []types.PermPath, history v1.History) ([]types.Layer, error) {
-	paths := getPaths(storePaths, parents, rewrites, exclude, perms)
-	return newLayers(paths, "", maxLayers, history)
+// groupPaths puts paths matching a layer group in the layer of this
+// group. Remaining paths are then grouped with strategy, the
+// PopularityStrategy when strategy is nil, by keeping the slots of
+// plan (see groupPathsWithPlan), in the layers left by the groups out
+// of maxLayers, at least one. It returns the groups, their names,
+// empty for the groups created by the strategy, and the plan of these
+// groups.
+func groupPaths(paths types.Paths, layerGroups []types.LayerGroup, strategy LayeringStrategy, infos map[string]PathInfo, maxLayers int, plan types.LayerPlan) ([]types.Paths, []string, types.LayerPlan, error) {
+	if strategy == nil {
+		strategy = PopularityStrategy{}
+	}
+	groups, names, rest, err := groupPathsByName(paths, layerGroups)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	strategyGroups := groupPathsWithPlan(rest, plan, strategy, infos, max(maxLayers-len(groups), 1))
+	for _, group := range strategyGroups {
+		groups = append(groups, group)
+		names = append(names, "")
+	}
+	return groups, names, newLayerPlan(strategyGroups), nil
 }
 
-func NewLayersNonReproducible(storePaths []string, maxLayers int, tarDirectory string, parents []types.Layer, rewrites []types.RewritePath, exclude string, perms []types.PermPath, history v1.History) (layers []types.Layer, err error) {
-	paths := getPaths(storePaths, parents, rewrites, exclude, perms)
-	return newLayers(paths, tarDirectory, maxLayers, history)
+// LayerOptions describes how store paths are put in layers. Its zero
+// value builds a single uncompressed layer.
+type LayerOptions struct {
+	// Store paths matching the regex of a layer group are put in
+	// the layer of this group
+	LayerGroups []types.LayerGroup
+	// The strategy grouping the other store paths, sorted by
+	// popularity, in at most MaxLayers layers, with the closure
+	// graph metadata Infos. It is the PopularityStrategy if nil
+	// and MaxLayers is 1 if 0.
+	Strategy  LayeringStrategy
+	MaxLayers int
+	Infos     map[string]PathInfo
+	// Store paths of the plan keep their layer slot
+	Plan types.LayerPlan
+	// If not 0, layers are split to be smaller than MaxLayerSize
+	// bytes
+	MaxLayerSize int64
+	// Store paths of the parent layers are not added again
+	Parents  []types.Layer
+	Rewrites []types.RewritePath
+	// Store paths matching this path are excluded
+	Exclude string
+	Perms   []types.PermPath
+	// Entries, which are files not in the Nix store, and deletions
+	// are added to the first layer
+	Entries   []types.Entry
+	Deletions []types.Deletion
+	// The directory perms set the owners and the mode of the
+	// directories which are not in the Nix store, such as
+	// /home/app, by destination path
+	DirectoryPerms []types.Perm
+	// If true, files sharing their inode are written as hard
+	// links: this requires the Nix store used to push the image to
+	// be optimised as the one used to build it
+	HardLinks   bool
+	History     v1.History
+	Compression Compression
+	// If not nil, the digests of reproducible layers are read from
+	// this cache (see DigestCache)
+	Cache *DigestCache
+	// The layers of at most Jobs groups, or one group per CPU if
+	// Jobs is 0, are built concurrently
+	Jobs int
 }
 
+// newLayersFromOptions builds the layers of storePaths. The layer
+// tarballs are written to tarDirectory, unless it is empty.
+func newLayersFromOptions(storePaths []string, tarDirectory string, opts LayerOptions) ([]types.Layer, types.LayerPlan, error) {
+	maxLayers := opts.MaxLayers
+	if maxLayers == 0 {
+		maxLayers = 1
+	}
+	compression := opts.Compression
+	if compression == "" {
+		compression = CompressionNone
+	}
+	paths, err := getPaths(storePaths, opts.Parents, opts.Rewrites, opts.Exclude, opts.Perms)
+	if err != nil {
+		return nil, nil, err
+	}
+	groups, names, plan, err := groupPaths(paths, opts.LayerGroups, opts.Strategy, opts.Infos, maxLayers, opts.Plan)
+	if err != nil {
+		return nil, nil, err
+	}
+	layers, err := newLayers(groups, names, opts.Infos, opts.Entries, opts.Deletions, opts.DirectoryPerms, opts.HardLinks, tarDirectory, opts.History, compression, opts.MaxLayerSize, opts.Cache, opts.Jobs)
+	return layers, plan, err
+}
+
+// NewLayers computes the digests of the layer blobs of storePaths
+// without writing them to the disk. It also returns the plan of the
+// created layers, to be used by the next build.
+func NewLayers(storePaths []string, opts LayerOptions) ([]types.Layer, types.LayerPlan, error) {
+	return newLayersFromOptions(storePaths, "", opts)
+}
+
+// NewLayersNonReproducible writes the layer tarballs of storePaths to
+// tarDirectory. The cache of opts is not used.
+func NewLayersNonReproducible(storePaths []string, tarDirectory string, opts LayerOptions) ([]types.Layer, types.LayerPlan, error) {
+	opts.Cache = nil
+	return newLayersFromOptions(storePaths, tarDirectory, opts)
+}
+
+// isPathInLayers returns true if path, or the pieces of path when its
+// layer has been split (see splitPaths), belongs to layers.
 func isPathInLayers(layers []types.Layer, path types.Path) bool {
 	for _, layer := range layers {
 		for _, p := range layer.Paths {
 			if reflect.DeepEqual(p, path) {
 				return true
 			}
+			if p.SplitFrom == path.Path && reflect.DeepEqual(p.Options, path.Options) {
+				return true
+			}
 		}
 	}
 	return false
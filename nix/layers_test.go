@@ -1,14 +1,27 @@
 package nix
 
 import (
+	"encoding/json"
+	"io"
+	"os"
 	"testing"
 
 	"github.com/nlewo/nix2container/types"
 	"github.com/stretchr/testify/assert"
 
+	digest "github.com/opencontainers/go-digest"
 	v1 "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
+// newTestLayers builds the reproducible layers of paths.
+func newTestLayers(t *testing.T, paths []string, opts LayerOptions) []types.Layer {
+	layers, _, err := NewLayers(paths, opts)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return layers
+}
+
 func TestPerms(t *testing.T) {
 	paths := []string{
 		"../data/layer1/file1",
@@ -20,10 +33,7 @@ func TestPerms(t *testing.T) {
 			Mode:  "0641",
 		},
 	}
-	layer, err := NewLayers(paths, 1, []types.Layer{}, []types.RewritePath{}, "", perms, v1.History{})
-	if err != nil {
-		t.Fatalf("%v", err)
-	}
+	layer := newTestLayers(t, paths, LayerOptions{Perms: perms})
 	expected := []types.Layer{
 		{
 			Digest:  "sha256:adf74a52f9e1bcd7dab77193455fa06743b979cf5955148010e5becedba4f72d",
@@ -52,10 +62,7 @@ func TestNewLayers(t *testing.T) {
 	paths := []string{
 		"../data/layer1/file1",
 	}
-	layer, err := NewLayers(paths, 1, []types.Layer{}, []types.RewritePath{}, "", []types.PermPath{}, v1.History{})
-	if err != nil {
-		t.Fatalf("%v", err)
-	}
+	layer := newTestLayers(t, paths, LayerOptions{})
 	expected := []types.Layer{
 		{
 			Digest:  "sha256:cc45bd46eca903b0900ebb997dffd5778904dca9ec02e7375dd1e653dfb61e2e",
@@ -72,7 +79,7 @@ func TestNewLayers(t *testing.T) {
 	assert.Equal(t, expected, layer)
 
 	tmpDir := t.TempDir()
-	layer, err = NewLayersNonReproducible(paths, 1, tmpDir, []types.Layer{}, []types.RewritePath{}, "", []types.PermPath{}, v1.History{})
+	layer, _, err := NewLayersNonReproducible(paths, tmpDir, LayerOptions{})
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
@@ -92,3 +99,209 @@ func TestNewLayers(t *testing.T) {
 	}
 	assert.Equal(t, expected, layer)
 }
+
+func TestNewLayersNonReproducibleCompressed(t *testing.T) {
+	paths := []string{
+		"../data/layer1/file1",
+	}
+	for _, compression := range []Compression{CompressionGzip, CompressionZstd} {
+		tmpDir := t.TempDir()
+		layers, _, err := NewLayersNonReproducible(paths, tmpDir, LayerOptions{Compression: compression})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		assert.Len(t, layers, 1)
+		layer := layers[0]
+		assert.Equal(t, "sha256:cc45bd46eca903b0900ebb997dffd5778904dca9ec02e7375dd1e653dfb61e2e", layer.DiffIDs)
+		assert.NotEqual(t, layer.DiffIDs, layer.Digest)
+		assert.Equal(t, compression.MediaType(), layer.MediaType)
+
+		content, err := os.ReadFile(layer.LayerPath)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		assert.Equal(t, layer.Digest, digest.FromBytes(content).String())
+		assert.Equal(t, int64(len(content)), layer.Size)
+		assert.Equal(t, tmpDir+"/"+digest.FromBytes(content).Encoded()+compression.extension(), layer.LayerPath)
+	}
+}
+
+func TestNewLayersCompressed(t *testing.T) {
+	paths := []string{
+		"../data/layer1/file1",
+	}
+	for _, compression := range []Compression{CompressionGzip, CompressionZstd} {
+		layers := newTestLayers(t, paths, LayerOptions{Compression: compression})
+		assert.Len(t, layers, 1)
+		layer := layers[0]
+		assert.Equal(t, "sha256:cc45bd46eca903b0900ebb997dffd5778904dca9ec02e7375dd1e653dfb61e2e", layer.DiffIDs)
+		assert.Equal(t, compression.MediaType(), layer.MediaType)
+		assert.Empty(t, layer.LayerPath)
+
+		// The blob streamed from the store paths must match the
+		// digest computed when the layer has been built.
+		reader, _, err := LayerGetBlob(layer)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		content, err := io.ReadAll(reader)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		assert.Nil(t, reader.Close())
+		assert.Equal(t, layer.Digest, digest.FromBytes(content).String())
+		assert.Equal(t, int64(len(content)), layer.Size)
+	}
+}
+
+func TestNewLayersWithGroups(t *testing.T) {
+	paths := []string{
+		"../data/layer1",
+		"../data/tar-directory/symlink",
+		"../data/tar-directory/file1",
+	}
+	layerGroups := []types.LayerGroup{
+		{Name: "tar-directory", Regex: "/tar-directory/"},
+	}
+	history := v1.History{CreatedBy: "nix2container"}
+	layers := newTestLayers(t, paths, LayerOptions{LayerGroups: layerGroups, History: history})
+	assert.Len(t, layers, 2)
+	assert.Equal(t, types.Paths{{Path: "../data/tar-directory/symlink"}, {Path: "../data/tar-directory/file1"}}, layers[0].Paths)
+	assert.Equal(t, v1.History{CreatedBy: "nix2container", Comment: "tar-directory"}, layers[0].History)
+	assert.Equal(t, types.Paths{{Path: "../data/layer1"}}, layers[1].Paths)
+	assert.Equal(t, history, layers[1].History)
+}
+
+func TestNewLayersWithGroupsMaxLayers(t *testing.T) {
+	paths := []string{
+		"../data/layer1",
+		"../data/graph-directory",
+		"../data/tar-directory/symlink",
+		"../data/tar-directory/file1",
+	}
+	layerGroups := []types.LayerGroup{
+		{Name: "symlink", Regex: "/symlink$"},
+		{Name: "file1", Regex: "/tar-directory/file1$"},
+	}
+	// Group layers count in the maximum number of layers
+	layers := newTestLayers(t, paths, LayerOptions{LayerGroups: layerGroups, MaxLayers: 3})
+	assert.Len(t, layers, 3)
+	assert.Equal(t, types.Paths{{Path: "../data/layer1"}, {Path: "../data/graph-directory"}}, layers[2].Paths)
+
+	// The other store paths still get a layer
+	layers = newTestLayers(t, paths, LayerOptions{LayerGroups: layerGroups, MaxLayers: 2})
+	assert.Len(t, layers, 3)
+
+	layers = newTestLayers(t, paths, LayerOptions{LayerGroups: layerGroups, MaxLayers: 4})
+	assert.Len(t, layers, 4)
+}
+
+func TestNewLayersDeletions(t *testing.T) {
+	deletions := []types.Deletion{{Path: "/etc/motd"}}
+	layers := newTestLayers(t, nil, LayerOptions{Deletions: deletions})
+	assert.Len(t, layers, 1)
+	assert.Nil(t, layers[0].Paths)
+	assert.Equal(t, deletions, layers[0].Deletions)
+
+	// The deletions are in the layer blob
+	reader, _, err := LayerGetBlob(layers[0])
+	assert.Nil(t, err)
+	defer reader.Close() // nolint: errcheck
+	d, err := digest.FromReader(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, layers[0].Digest, d.String())
+
+	// Deletions are only added to the first layer
+	paths := []string{"../data/layer1", "../data/tar-directory"}
+	layers = newTestLayers(t, paths, LayerOptions{MaxLayers: 2, Deletions: deletions})
+	assert.Len(t, layers, 2)
+	assert.Equal(t, deletions, layers[0].Deletions)
+	assert.Nil(t, layers[1].Deletions)
+}
+
+func TestNewLayersEntries(t *testing.T) {
+	entries := []types.Entry{{Type: "directory", Path: "/tmp", Mode: "1777"}}
+	layers := newTestLayers(t, nil, LayerOptions{Entries: entries})
+	assert.Len(t, layers, 1)
+	assert.Equal(t, entries, layers[0].Entries)
+
+	// The entries are in the layer blob
+	reader, _, err := LayerGetBlob(layers[0])
+	assert.Nil(t, err)
+	defer reader.Close() // nolint: errcheck
+	d, err := digest.FromReader(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, layers[0].Digest, d.String())
+}
+
+func TestNewLayersRewrites(t *testing.T) {
+	paths := []string{"../data/tar-directory"}
+	rewrites := []types.RewritePath{
+		{Path: "../data/tar-directory", Regex: "^../data/tar-directory", Repl: "/etc"},
+		{Path: "../data/tar-directory", Regex: "^/etc/file1$", Repl: "/etc/file2"},
+	}
+	layers := newTestLayers(t, paths, LayerOptions{Rewrites: rewrites})
+	expected := []types.Rewrite{
+		{Regex: "^../data/tar-directory", Repl: "/etc"},
+		{Regex: "^/etc/file1$", Repl: "/etc/file2"},
+	}
+	assert.Equal(t, expected, layers[0].Paths[0].Options.Rewrites)
+
+	rewrites = append(rewrites, types.RewritePath{Path: "../data/tar-directory", Regex: "^../data/tar-directory", Repl: "/usr"})
+	_, _, err := NewLayers(paths, LayerOptions{Rewrites: rewrites})
+	assert.EqualError(t, err, "the path '../data/tar-directory' has several rewrites of the regex '^../data/tar-directory'")
+}
+
+func TestPathOptionsRewriteField(t *testing.T) {
+	// Layers written by older versions have a single rewrite
+	content := `[{"path": "../data/tar-directory", "options": {"rewrite": {"regex": "^../data/tar-directory", "repl": "/etc"}}}]`
+	var paths types.Paths
+	assert.Nil(t, json.Unmarshal([]byte(content), &paths))
+	expected := types.Paths{{
+		Path: "../data/tar-directory",
+		Options: &types.PathOptions{
+			Rewrites: []types.Rewrite{{Regex: "^../data/tar-directory", Repl: "/etc"}},
+		},
+	}}
+	assert.Equal(t, expected, paths)
+
+	// An empty rewrite was written when paths were not rewritten
+	content = `[{"path": "../data/tar-directory", "options": {"rewrite": {"regex": "", "repl": ""}}}]`
+	assert.Nil(t, json.Unmarshal([]byte(content), &paths))
+	assert.Equal(t, types.Paths{{Path: "../data/tar-directory", Options: &types.PathOptions{}}}, paths)
+
+	content = `[{"path": "../data/tar-directory", "options": {"rewrite": {"regex": "^/a", "repl": "/b"}, "rewrites": [{"regex": "^/c", "repl": "/d"}]}}]`
+	err := json.Unmarshal([]byte(content), &paths)
+	assert.EqualError(t, err, "the options contain both the rewrite and the rewrites fields")
+}
+
+func TestNewLayersJobs(t *testing.T) {
+	paths := []string{"../data/layer1", "../data/tar-directory", "../data/graph-directory"}
+	expected := newTestLayers(t, paths, LayerOptions{MaxLayers: 3, Jobs: 1})
+	assert.Len(t, expected, 3)
+	// Layers built concurrently are in the same order
+	layers := newTestLayers(t, paths, LayerOptions{MaxLayers: 3})
+	assert.Equal(t, expected, layers)
+
+	_, _, err := NewLayers(append(paths, "../data/nonexistent"), LayerOptions{MaxLayers: 4})
+	assert.ErrorContains(t, err, "failed accessing path \"../data/nonexistent\"")
+}
+
+func TestNewLayersPopularity(t *testing.T) {
+	paths := []string{"../data/layer1", "../data/tar-directory"}
+	infos := map[string]PathInfo{
+		"../data/layer1":        {Popularity: 2},
+		"../data/tar-directory": {Popularity: 3},
+	}
+	layers := newTestLayers(t, paths, LayerOptions{MaxLayers: 1, Infos: infos})
+	assert.Len(t, layers, 1)
+	assert.Equal(t, int64(5), layers[0].Popularity)
+
+	// A split store path is only counted once
+	split := types.Paths{
+		{Path: "../data/layer1/file1", SplitFrom: "../data/layer1"},
+		{Path: "../data/layer1/file2", SplitFrom: "../data/layer1"},
+		{Path: "../data/tar-directory"},
+	}
+	assert.Equal(t, int64(5), pathsPopularity(split, infos))
+}
@@ -0,0 +1,121 @@
+package nix
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The set-user-ID, set-group-ID and sticky bits of a tar header mode
+const (
+	modeSetuid = 0o4000
+	modeSetgid = 0o2000
+	modeSticky = 0o1000
+)
+
+// applyMode returns the mode of a file, whose mode is current, once
+// mode has been applied. The mode is either an octal number replacing
+// the current mode or a list of comma separated chmod symbolic
+// expressions, such as g+w, u+s, a-x or a+X, modifying the current
+// mode.
+func applyMode(mode string, current int64, isDir bool) (int64, error) {
+	if mode == "" {
+		return 0, fmt.Errorf("the mode is empty")
+	}
+	if isOctalMode(mode) {
+		return parseOctalMode(mode)
+	}
+	for _, clause := range strings.Split(mode, ",") {
+		var err error
+		current, err = applySymbolicMode(clause, current, isDir)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return current, nil
+}
+
+// isOctalMode returns true if the mode is only made of octal digits.
+func isOctalMode(mode string) bool {
+	return mode != "" && strings.Trim(mode, "01234567") == ""
+}
+
+// parseOctalMode parses an octal mode such as 0755 or 4755.
+func parseOctalMode(mode string) (int64, error) {
+	if !isOctalMode(mode) {
+		return 0, fmt.Errorf("the mode '%s' is not an octal number", mode)
+	}
+	m, err := strconv.ParseInt(mode, 8, 64)
+	if err != nil || m > 0o7777 {
+		return 0, fmt.Errorf("the octal mode '%s' is out of range", mode)
+	}
+	return m, nil
+}
+
+// applySymbolicMode applies a chmod symbolic expression such as
+// ug+rw-x to the current mode. When no user is specified, the
+// expression applies to all of them.
+func applySymbolicMode(clause string, current int64, isDir bool) (int64, error) {
+	var who, special int64
+	i := 0
+	for ; i < len(clause) && strings.IndexByte("ugoa", clause[i]) >= 0; i++ {
+		switch clause[i] {
+		case 'u':
+			who |= 0o700
+			special |= modeSetuid
+		case 'g':
+			who |= 0o070
+			special |= modeSetgid
+		case 'o':
+			who |= 0o007
+			special |= modeSticky
+		case 'a':
+			who |= 0o777
+			special |= modeSetuid | modeSetgid | modeSticky
+		}
+	}
+	if who == 0 {
+		who = 0o777
+		special = modeSetuid | modeSetgid | modeSticky
+	}
+	if i == len(clause) {
+		return 0, fmt.Errorf("the symbolic mode '%s' has no operator (expected +, - or =)", clause)
+	}
+	for i < len(clause) {
+		op := clause[i]
+		if op != '+' && op != '-' && op != '=' {
+			return 0, fmt.Errorf("the symbolic mode '%s' has the unexpected character '%c' (expected +, - or =)", clause, op)
+		}
+		i++
+		var bits int64
+		for ; i < len(clause) && strings.IndexByte("+-=", clause[i]) < 0; i++ {
+			switch clause[i] {
+			case 'r':
+				bits |= 0o444 & who
+			case 'w':
+				bits |= 0o222 & who
+			case 'x':
+				bits |= 0o111 & who
+			case 'X':
+				if isDir || current&0o111 != 0 {
+					bits |= 0o111 & who
+				}
+			case 's':
+				bits |= special & (modeSetuid | modeSetgid)
+			case 't':
+				bits |= special & modeSticky
+			default:
+				return 0, fmt.Errorf("the symbolic mode '%s' has the unexpected permission '%c' (expected r, w, x, X, s or t)", clause, clause[i])
+			}
+		}
+		switch op {
+		case '+':
+			current |= bits
+		case '-':
+			current &^= bits
+		case '=':
+			current = current&^(who|special) | bits
+		}
+	}
+	return current, nil
+}
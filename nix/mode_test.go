@@ -0,0 +1,47 @@
+package nix
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyMode(t *testing.T) {
+	testCases := []struct {
+		mode     string
+		current  int64
+		isDir    bool
+		expected int64
+	}{
+		{"0644", 0o755, false, 0o644},
+		{"4755", 0o644, false, 0o4755},
+		{"g+w", 0o644, false, 0o664},
+		{"u+s", 0o755, false, 0o4755},
+		{"a-x", 0o755, false, 0o644},
+		{"-x", 0o755, false, 0o644},
+		{"a+X", 0o644, false, 0o644},
+		{"a+X", 0o744, false, 0o755},
+		{"a+X", 0o600, true, 0o711},
+		{"go=rx", 0o700, false, 0o755},
+		{"+t", 0o777, true, 0o1777},
+		{"u=rw,go-rwx", 0o755, false, 0o600},
+		{"ug+w-x", 0o755, false, 0o665},
+		{"g-s", 0o2775, true, 0o775},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.mode, func(t *testing.T) {
+			mode, err := applyMode(tc.mode, tc.current, tc.isDir)
+			assert.Nil(t, err)
+			assert.Equal(t, tc.expected, mode, "%o != %o", tc.expected, mode)
+		})
+	}
+
+	_, err := applyMode("g+q", 0o644, false)
+	assert.EqualError(t, err, "the symbolic mode 'g+q' has the unexpected permission 'q' (expected r, w, x, X, s or t)")
+	_, err = applyMode("g", 0o644, false)
+	assert.EqualError(t, err, "the symbolic mode 'g' has no operator (expected +, - or =)")
+	_, err = applyMode("uz+w", 0o644, false)
+	assert.EqualError(t, err, "the symbolic mode 'uz+w' has the unexpected character 'z' (expected +, - or =)")
+	_, err = applyMode("17777", 0o644, false)
+	assert.EqualError(t, err, "the octal mode '17777' is out of range")
+}
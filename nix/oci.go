@@ -0,0 +1,157 @@
+package nix
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+)
+
+// WriteOCILayout writes an image to directory as an OCI image
+// layout: the oci-layout file, the index.json file and all blobs in
+// blobs/sha256.
+func WriteOCILayout(image types.Image, directory string) error {
+	blobsDirectory, err := createOCILayout(directory)
+	if err != nil {
+		return err
+	}
+	descriptor, err := writeOCILayoutImage(image, blobsDirectory)
+	if err != nil {
+		return err
+	}
+	return writeOCILayoutIndex(directory, descriptor)
+}
+
+// WriteOCILayoutImageIndex writes a multi-architecture image to
+// directory as an OCI image layout. The index.json file references
+// the image index, which references the manifest of each platform.
+func WriteOCILayoutImageIndex(index types.ImageIndex, directory string) error {
+	blobsDirectory, err := createOCILayout(directory)
+	if err != nil {
+		return err
+	}
+	for _, image := range index.Images {
+		if _, err := writeOCILayoutImage(image, blobsDirectory); err != nil {
+			return err
+		}
+	}
+	indexBlob, err := GetIndexManifest(index)
+	if err != nil {
+		return err
+	}
+	indexDigest := godigest.FromBytes(indexBlob)
+	if err := os.WriteFile(filepath.Join(blobsDirectory, indexDigest.Encoded()), indexBlob, 0644); err != nil {
+		return err
+	}
+	return writeOCILayoutIndex(directory, v1.Descriptor{
+		MediaType: v1.MediaTypeImageIndex,
+		Digest:    indexDigest,
+		Size:      int64(len(indexBlob)),
+	})
+}
+
+// createOCILayout creates the layout directories and the oci-layout
+// file. It returns the path of the blobs directory.
+func createOCILayout(directory string) (string, error) {
+	blobsDirectory := filepath.Join(directory, v1.ImageBlobsDir, godigest.Canonical.String())
+	if err := os.MkdirAll(blobsDirectory, 0755); err != nil {
+		return "", err
+	}
+	layoutBlob, err := json.Marshal(v1.ImageLayout{Version: v1.ImageLayoutVersion})
+	if err != nil {
+		return "", err
+	}
+	return blobsDirectory, os.WriteFile(filepath.Join(directory, v1.ImageLayoutFile), layoutBlob, 0644)
+}
+
+// writeOCILayoutImage writes the layers, the config and the manifest
+// of an image to the blobs directory. It returns the descriptor of
+// the manifest.
+func writeOCILayoutImage(image types.Image, blobsDirectory string) (v1.Descriptor, error) {
+	for _, layer := range image.Layers {
+		// Layers can be shared by the images of an index
+		if d, err := godigest.Parse(layer.Digest); err == nil {
+			if _, err := os.Stat(filepath.Join(blobsDirectory, d.Encoded())); err == nil {
+				continue
+			}
+		}
+		reader, _, err := LayerGetBlob(layer)
+		if err != nil {
+			return v1.Descriptor{}, err
+		}
+		logrus.Infof("Writing layer %s", layer.Digest)
+		err = writeBlob(blobsDirectory, reader, layer.Digest)
+		reader.Close() // nolint: errcheck
+		if err != nil {
+			return v1.Descriptor{}, err
+		}
+	}
+
+	configBlob, err := GetConfigBlob(image)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	configDigest := godigest.FromBytes(configBlob)
+	if err := os.WriteFile(filepath.Join(blobsDirectory, configDigest.Encoded()), configBlob, 0644); err != nil {
+		return v1.Descriptor{}, err
+	}
+
+	manifestBlob, err := GetManifest(image)
+	if err != nil {
+		return v1.Descriptor{}, err
+	}
+	manifestDigest := godigest.FromBytes(manifestBlob)
+	if err := os.WriteFile(filepath.Join(blobsDirectory, manifestDigest.Encoded()), manifestBlob, 0644); err != nil {
+		return v1.Descriptor{}, err
+	}
+	return v1.Descriptor{
+		MediaType: v1.MediaTypeImageManifest,
+		Digest:    manifestDigest,
+		Size:      int64(len(manifestBlob)),
+	}, nil
+}
+
+// writeOCILayoutIndex writes the index.json file referencing the
+// descriptor.
+func writeOCILayoutIndex(directory string, descriptor v1.Descriptor) error {
+	index := v1.Index{
+		MediaType: v1.MediaTypeImageIndex,
+		Manifests: []v1.Descriptor{descriptor},
+	}
+	index.SchemaVersion = 2
+	indexBlob, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(directory, v1.ImageIndexFile), indexBlob, 0644)
+}
+
+// writeBlob writes the content of reader to the blobs directory and
+// checks its digest is the expected one.
+func writeBlob(blobsDirectory string, reader io.Reader, expected string) error {
+	f, err := os.CreateTemp(blobsDirectory, "")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // nolint: errcheck
+	defer f.Close()           // nolint: errcheck
+
+	digester := godigest.Canonical.Digester()
+	if _, err := io.Copy(io.MultiWriter(f, digester.Hash()), reader); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	digest := digester.Digest()
+	if digest.String() != expected {
+		return fmt.Errorf("the blob digest is '%s' while the layer digest is '%s'", digest, expected)
+	}
+	return os.Rename(f.Name(), filepath.Join(blobsDirectory, digest.Encoded()))
+}
@@ -0,0 +1,61 @@
+package nix
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteOCILayout(t *testing.T) {
+	paths := []string{
+		"../data/layer1/file1",
+	}
+	layers := newTestLayers(t, paths, LayerOptions{Compression: CompressionGzip})
+	image := types.Image{
+		Version: types.ImageVersion,
+		Arch:    "amd64",
+		Layers:  layers,
+	}
+
+	directory := t.TempDir()
+	err := WriteOCILayout(image, directory)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(directory, "oci-layout"))
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"imageLayoutVersion": "1.0.0"}`, string(content))
+
+	var index v1.Index
+	content, err = os.ReadFile(filepath.Join(directory, "index.json"))
+	assert.Nil(t, err)
+	assert.Nil(t, json.Unmarshal(content, &index))
+	assert.Len(t, index.Manifests, 1)
+
+	blob := func(digest godigest.Digest) []byte {
+		content, err := os.ReadFile(filepath.Join(directory, "blobs", "sha256", digest.Encoded()))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		assert.Equal(t, digest, godigest.FromBytes(content))
+		return content
+	}
+	var manifest v1.Manifest
+	assert.Nil(t, json.Unmarshal(blob(index.Manifests[0].Digest), &manifest))
+	assert.Len(t, manifest.Layers, 1)
+	assert.Equal(t, layers[0].Digest, manifest.Layers[0].Digest.String())
+	assert.Equal(t, layers[0].Size, manifest.Layers[0].Size)
+	assert.Equal(t, v1.MediaTypeImageLayerGzip, manifest.Layers[0].MediaType)
+	assert.Equal(t, layers[0].Size, int64(len(blob(manifest.Layers[0].Digest))))
+
+	var config v1.Image
+	assert.Nil(t, json.Unmarshal(blob(manifest.Config.Digest), &config))
+	assert.Equal(t, "amd64", config.Architecture)
+}
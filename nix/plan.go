@@ -0,0 +1,77 @@
+package nix
+
+import (
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	"github.com/nlewo/nix2container/types"
+)
+
+// StorePathHash matches the hash prefix of the base name of a store
+// path, such as <hash>- in /nix/store/<hash>-bash-5.2.
+var StorePathHash = regexp.MustCompile("^[0-9a-z]{32}-")
+
+// storePathName returns the name of a store path without its hash,
+// such as bash-5.2 for /nix/store/<hash>-bash-5.2. This name is
+// stable across rebuilds.
+func storePathName(path string) string {
+	return StorePathHash.ReplaceAllString(filepath.Base(path), "")
+}
+
+// groupPathsWithPlan groups paths as the previous build described by
+// plan did. Paths of the plan keep their slot, if it is lower than
+// maxLayers, while new paths are grouped by strategy in the remaining
+// layers. If all layers are already used, new paths are added to the
+// last one.
+//
+// Empty slots are dropped, which only shifts the slot numbers of the
+// following layers: their content, and thus their digest, don't
+// change.
+func groupPathsWithPlan(paths types.Paths, plan types.LayerPlan, strategy LayeringStrategy, infos map[string]PathInfo, maxLayers int) []types.Paths {
+	if len(plan) == 0 {
+		return strategy.Group(paths, infos, maxLayers)
+	}
+	locked := make(map[int]types.Paths)
+	var fresh types.Paths
+	for _, p := range paths {
+		slot, ok := plan[storePathName(p.Path)]
+		if ok && slot >= 0 && slot < maxLayers {
+			locked[slot] = append(locked[slot], p)
+		} else {
+			fresh = append(fresh, p)
+		}
+	}
+	slots := make([]int, 0, len(locked))
+	for slot := range locked {
+		slots = append(slots, slot)
+	}
+	sort.Ints(slots)
+	groups := make([]types.Paths, 0, len(slots))
+	for _, slot := range slots {
+		groups = append(groups, locked[slot])
+	}
+	if len(fresh) == 0 {
+		return groups
+	}
+	if len(groups) == 0 {
+		return strategy.Group(fresh, infos, maxLayers)
+	}
+	if free := maxLayers - len(groups); free > 0 {
+		return append(groups, strategy.Group(fresh, infos, free)...)
+	}
+	last := len(groups) - 1
+	groups[last] = append(groups[last], fresh...)
+	return groups
+}
+
+// newLayerPlan returns the plan of the layers built from groups.
+func newLayerPlan(groups []types.Paths) types.LayerPlan {
+	plan := make(types.LayerPlan)
+	for slot, group := range groups {
+		for _, p := range group {
+			plan[storePathName(p.Path)] = slot
+		}
+	}
+	return plan
+}
@@ -0,0 +1,41 @@
+package nix
+
+import (
+	"testing"
+
+	"github.com/nlewo/nix2container/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStorePathName(t *testing.T) {
+	assert.Equal(t, "bash-5.2", storePathName("/nix/store/0123456789abcdfghijklmnpqrsvwxyz-bash-5.2"))
+	assert.Equal(t, "file1", storePathName("../data/layer1/file1"))
+}
+
+func TestGroupPathsWithPlan(t *testing.T) {
+	paths := testPaths("A", "B", "C", "D")
+
+	// Without plan, the strategy is used
+	assert.Equal(t, groupPathsByPopularity(paths, 3), groupPathsWithPlan(paths, nil, PopularityStrategy{}, nil, 3))
+
+	// Paths of the plan keep their slot while the new path D gets
+	// the free layer
+	plan := types.LayerPlan{"B": 0, "A": 1, "C": 1}
+	expected := []types.Paths{testPaths("B"), testPaths("A", "C"), testPaths("D")}
+	assert.Equal(t, expected, groupPathsWithPlan(paths, plan, PopularityStrategy{}, nil, 3))
+
+	// Without free layer, the new path is added to the last layer
+	expected = []types.Paths{testPaths("B"), testPaths("A", "C", "D")}
+	assert.Equal(t, expected, groupPathsWithPlan(paths, plan, PopularityStrategy{}, nil, 2))
+
+	// Slots are not kept when the number of layers is reduced
+	expected = []types.Paths{testPaths("B", "A", "C", "D")}
+	assert.Equal(t, expected, groupPathsWithPlan(paths, plan, PopularityStrategy{}, nil, 1))
+
+	// Empty slots are dropped
+	plan = types.LayerPlan{"A": 0, "removed": 1, "B": 2, "C": 2, "D": 3}
+	expected = []types.Paths{testPaths("A"), testPaths("B", "C"), testPaths("D")}
+	groups := groupPathsWithPlan(paths, plan, PopularityStrategy{}, nil, 4)
+	assert.Equal(t, expected, groups)
+	assert.Equal(t, types.LayerPlan{"A": 0, "B": 1, "C": 1, "D": 2}, newLayerPlan(groups))
+}
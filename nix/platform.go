@@ -0,0 +1,111 @@
+package nix
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// archAliases maps architecture names used by uname, Debian or Nix
+// to their OCI names.
+var archAliases = map[string]string{
+	"x86_64":  "amd64",
+	"x86-64":  "amd64",
+	"i386":    "386",
+	"i686":    "386",
+	"aarch64": "arm64",
+	"armhf":   "arm",
+	"armel":   "arm",
+	"armv5l":  "arm",
+	"armv6l":  "arm",
+	"armv7l":  "arm",
+	"ppc64el": "ppc64le",
+}
+
+// archAliasVariants are the variants implied by some architecture
+// aliases.
+var archAliasVariants = map[string]string{
+	"armhf":  "v7",
+	"armel":  "v6",
+	"armv5l": "v5",
+	"armv6l": "v6",
+	"armv7l": "v7",
+}
+
+// knownVariants lists the architectures supported on Linux and their
+// valid variants, as described by the OCI image index specification
+// and used by container runtimes.
+var knownVariants = map[string][]string{
+	"386":      {},
+	"amd64":    {"v1", "v2", "v3", "v4"},
+	"arm":      {"v5", "v6", "v7", "v8"},
+	"arm64":    {"v8", "v8.1", "v8.2", "v8.3", "v8.4", "v8.5", "v8.6", "v8.7", "v8.8", "v8.9", "v9", "v9.1", "v9.2", "v9.3", "v9.4", "v9.5"},
+	"loong64":  {},
+	"mips":     {},
+	"mipsle":   {},
+	"mips64":   {},
+	"mips64le": {},
+	"ppc64":    {"power8", "power9", "power10"},
+	"ppc64le":  {"power8", "power9", "power10"},
+	"riscv64":  {"rva20u64", "rva22u64", "rva23u64"},
+	"s390x":    {},
+	"wasm":     {},
+}
+
+// NormalizePlatform maps an architecture and a variant to their OCI
+// names. The architecture can be a Go (GOARCH) or a uname name such as
+// x86_64 or armv7l. The variant can be given as the value of the
+// GOARM, GOAMD64 or GOARM64 Go environment variables, such as 7 for
+// GOARCH=arm and GOARM=7.
+func NormalizePlatform(arch, variant string) (string, string) {
+	if alias, ok := archAliases[arch]; ok {
+		if variant == "" {
+			variant = archAliasVariants[arch]
+		}
+		arch = alias
+	}
+	// GOARM can contain a floating point option, such as 7,softfloat
+	variant, _, _ = strings.Cut(variant, ",")
+	switch arch {
+	case "arm":
+		if variant != "" && !strings.HasPrefix(variant, "v") {
+			variant = "v" + variant
+		}
+	case "arm64":
+		// GOARM64 values are v8.0, v8.1, ...
+		if variant == "v8.0" || variant == "8" {
+			variant = "v8"
+		}
+		if variant == "v9.0" || variant == "9" {
+			variant = "v9"
+		}
+	}
+	return arch, variant
+}
+
+// ValidatePlatform checks the platform is a known OCI platform
+// combination.
+func ValidatePlatform(platform v1.Platform) error {
+	if platform.OS != "linux" {
+		return fmt.Errorf("unsupported OS '%s'", platform.OS)
+	}
+	variants, ok := knownVariants[platform.Architecture]
+	if !ok {
+		return fmt.Errorf("unknown architecture '%s' for the OS %s", platform.Architecture, platform.OS)
+	}
+	if platform.Variant != "" && !slices.Contains(variants, platform.Variant) {
+		if len(variants) == 0 {
+			return fmt.Errorf("the architecture '%s' doesn't support variants (got '%s')", platform.Architecture, platform.Variant)
+		}
+		return fmt.Errorf("unknown variant '%s' for the architecture '%s' (expected one of %s)",
+			platform.Variant, platform.Architecture, strings.Join(variants, ", "))
+	}
+	for _, feature := range platform.OSFeatures {
+		if feature == "" {
+			return fmt.Errorf("OS features can not be empty strings")
+		}
+	}
+	return nil
+}
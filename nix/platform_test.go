@@ -0,0 +1,39 @@
+package nix
+
+import (
+	"testing"
+
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizePlatform(t *testing.T) {
+	for _, c := range []struct {
+		arch, variant, expectedArch, expectedVariant string
+	}{
+		{"amd64", "", "amd64", ""},
+		{"x86_64", "", "amd64", ""},
+		{"arm", "7", "arm", "v7"},
+		{"arm", "6,softfloat", "arm", "v6"},
+		{"arm", "v7", "arm", "v7"},
+		{"armv7l", "", "arm", "v7"},
+		{"aarch64", "", "arm64", ""},
+		{"arm64", "v8.0", "arm64", "v8"},
+		{"riscv64", "", "riscv64", ""},
+	} {
+		arch, variant := NormalizePlatform(c.arch, c.variant)
+		assert.Equal(t, c.expectedArch, arch, "arch of %s/%s", c.arch, c.variant)
+		assert.Equal(t, c.expectedVariant, variant, "variant of %s/%s", c.arch, c.variant)
+	}
+}
+
+func TestValidatePlatform(t *testing.T) {
+	assert.Nil(t, ValidatePlatform(v1.Platform{OS: "linux", Architecture: "amd64"}))
+	assert.Nil(t, ValidatePlatform(v1.Platform{OS: "linux", Architecture: "arm", Variant: "v7"}))
+	assert.Nil(t, ValidatePlatform(v1.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}))
+	assert.Nil(t, ValidatePlatform(v1.Platform{OS: "linux", Architecture: "riscv64"}))
+	assert.Error(t, ValidatePlatform(v1.Platform{OS: "linux", Architecture: "arm", Variant: "v9"}))
+	assert.Error(t, ValidatePlatform(v1.Platform{OS: "linux", Architecture: "s390x", Variant: "v1"}))
+	assert.Error(t, ValidatePlatform(v1.Platform{OS: "linux", Architecture: "x86_64"}))
+	assert.Error(t, ValidatePlatform(v1.Platform{OS: "windows", Architecture: "amd64"}))
+}
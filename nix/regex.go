@@ -0,0 +1,133 @@
+package nix
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/nlewo/nix2container/types"
+)
+
+// pathOptions are the options of a path with their regexes compiled
+// once, since they are matched against each file of the path. The
+// regexes are in the order of the rewrites and the perms of the
+// options.
+type pathOptions struct {
+	*types.PathOptions
+	rewrites []*regexp.Regexp
+	perms    []*regexp.Regexp
+}
+
+// compilePathOptions checks options and compiles their regexes. It
+// returns nil if options is nil.
+func compilePathOptions(options *types.PathOptions) (*pathOptions, error) {
+	if options == nil {
+		return nil, nil
+	}
+	compiled := &pathOptions{PathOptions: options}
+	for i, rewrite := range options.Rewrites {
+		re, err := compileRegex(rewrite.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("the rewrite %d is invalid: %w", i, err)
+		}
+		compiled.rewrites = append(compiled.rewrites, re)
+	}
+	perms, err := compilePerms(options.Perms)
+	if err != nil {
+		return nil, err
+	}
+	compiled.perms = perms
+	return compiled, nil
+}
+
+// compilePerms checks perms and compiles their regexes.
+func compilePerms(perms []types.Perm) ([]*regexp.Regexp, error) {
+	var regexes []*regexp.Regexp
+	for i, perm := range perms {
+		re, err := compilePerm(perm)
+		if err != nil {
+			return nil, fmt.Errorf("the perm %d is invalid: %w", i, err)
+		}
+		regexes = append(regexes, re)
+	}
+	return regexes, nil
+}
+
+// compileRegex compiles expr.
+func compileRegex(expr string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("could not compile the regex '%s': %w", expr, err)
+	}
+	return re, nil
+}
+
+// compilePerm checks the match, the type, the mode and the
+// capabilities of perm and compiles its regex. The mode is checked by
+// applying it to a file mode.
+func compilePerm(perm types.Perm) (*regexp.Regexp, error) {
+	switch perm.Match {
+	case "", "source", "destination":
+	default:
+		return nil, fmt.Errorf("the match '%s' is not supported (expected source or destination)", perm.Match)
+	}
+	switch perm.Type {
+	case "", "file", "dir", "symlink", "executable":
+	default:
+		return nil, fmt.Errorf("the type '%s' is not supported (expected file, dir, symlink or executable)", perm.Type)
+	}
+	if perm.Mode != "" {
+		if _, err := applyMode(perm.Mode, 0o644, false); err != nil {
+			return nil, fmt.Errorf("invalid mode '%s': %w", perm.Mode, err)
+		}
+	}
+	if value, ok := perm.Xattrs[capabilityXattr]; ok {
+		if _, err := encodeCapabilities(value); err != nil {
+			return nil, fmt.Errorf("invalid capabilities '%s': %w", value, err)
+		}
+	}
+	return compileRegex(perm.Regex)
+}
+
+// ValidateRewrites compiles the regexes of rewrites. The error names
+// the index and the path of the first invalid rewrite.
+func ValidateRewrites(rewrites []types.RewritePath) error {
+	for i, rewrite := range rewrites {
+		if _, err := compileRegex(rewrite.Regex); err != nil {
+			return fmt.Errorf("the rewrite %d of the path '%s' is invalid: %w", i, rewrite.Path, err)
+		}
+	}
+	return nil
+}
+
+// ValidatePermPaths checks perms and compiles their regexes. The error
+// names the index and the path of the first invalid perm.
+func ValidatePermPaths(perms []types.PermPath) error {
+	for i, perm := range perms {
+		if _, err := compilePerm(permOf(perm)); err != nil {
+			return fmt.Errorf("the perm %d of the path '%s' is invalid: %w", i, perm.Path, err)
+		}
+	}
+	return nil
+}
+
+// ValidatePerms checks perms, such as directory perms, and compiles
+// their regexes. The error names the index of the first invalid perm.
+func ValidatePerms(perms []types.Perm) error {
+	_, err := compilePerms(perms)
+	return err
+}
+
+// ValidateLayerGroups checks the names of layer groups and compiles
+// their regexes. The error names the index of the first invalid layer
+// group.
+func ValidateLayerGroups(layerGroups []types.LayerGroup) error {
+	for i, layerGroup := range layerGroups {
+		if layerGroup.Name == "" {
+			return fmt.Errorf("the layer group %d has no name", i)
+		}
+		if _, err := compileRegex(layerGroup.Regex); err != nil {
+			return fmt.Errorf("the layer group %d ('%s') is invalid: %w", i, layerGroup.Name, err)
+		}
+	}
+	return nil
+}
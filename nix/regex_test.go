@@ -0,0 +1,52 @@
+package nix
+
+import (
+	"testing"
+
+	"github.com/nlewo/nix2container/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateRegexes(t *testing.T) {
+	rewrites := []types.RewritePath{
+		{Path: "/nix/store/hash-app", Regex: "^/nix/store/hash-app"},
+		{Path: "/nix/store/hash-app", Regex: "^/share/[a-z"},
+	}
+	err := ValidateRewrites(rewrites)
+	assert.EqualError(t, err, "the rewrite 1 of the path '/nix/store/hash-app' is invalid: could not compile the regex '^/share/[a-z': error parsing regexp: missing closing ]: `[a-z`")
+	assert.Nil(t, ValidateRewrites(rewrites[:1]))
+
+	perms := []types.PermPath{{Path: "/nix/store/hash-app", Regex: "*.sh"}}
+	err = ValidatePermPaths(perms)
+	assert.EqualError(t, err, "the perm 0 of the path '/nix/store/hash-app' is invalid: could not compile the regex '*.sh': error parsing regexp: missing argument to repetition operator: `*`")
+
+	err = ValidatePerms([]types.Perm{{Regex: "^/home/app$"}, {Regex: "("}})
+	assert.EqualError(t, err, "the perm 1 is invalid: could not compile the regex '(': error parsing regexp: missing closing ): `(`")
+
+	// The match and the type of perms are checked
+	err = ValidatePermPaths([]types.PermPath{{Path: "/nix/store/hash-app", Regex: ".*", Match: "target"}})
+	assert.EqualError(t, err, "the perm 0 of the path '/nix/store/hash-app' is invalid: the match 'target' is not supported (expected source or destination)")
+	err = ValidatePerms([]types.Perm{{Regex: "^/run$", Type: "socket"}})
+	assert.EqualError(t, err, "the perm 0 is invalid: the type 'socket' is not supported (expected file, dir, symlink or executable)")
+
+	groups := []types.LayerGroup{{Name: "app", Regex: "^/nix/store/[^/]*-app"}, {Name: "lib", Regex: "lib("}}
+	err = ValidateLayerGroups(groups)
+	assert.EqualError(t, err, "the layer group 1 ('lib') is invalid: could not compile the regex 'lib(': error parsing regexp: missing closing ): `lib(`")
+	err = ValidateLayerGroups([]types.LayerGroup{{Regex: "^/nix/store/[^/]*-app"}})
+	assert.EqualError(t, err, "the layer group 0 has no name")
+	assert.Nil(t, ValidateLayerGroups(groups[:1]))
+}
+
+func TestValidatePermModes(t *testing.T) {
+	err := ValidatePermPaths([]types.PermPath{{Path: "/nix/store/hash-app", Regex: ".*", Mode: "u+q"}})
+	assert.EqualError(t, err, "the perm 0 of the path '/nix/store/hash-app' is invalid: invalid mode 'u+q': the symbolic mode 'u+q' has the unexpected permission 'q' (expected r, w, x, X, s or t)")
+	err = ValidatePerms([]types.Perm{{Regex: "^/home/app$", Mode: "0700"}, {Regex: "^/run$", Mode: "g"}})
+	assert.EqualError(t, err, "the perm 1 is invalid: invalid mode 'g': the symbolic mode 'g' has no operator (expected +, - or =)")
+	assert.Nil(t, ValidatePerms([]types.Perm{{Regex: ".*", Mode: "g+w,a+X"}}))
+
+	xattrs := map[string]string{"security.capability": "cap_no_such_thing=+ep"}
+	err = ValidatePermPaths([]types.PermPath{{Path: "/nix/store/hash-app", Regex: ".*", Xattrs: xattrs}})
+	assert.ErrorContains(t, err, "the perm 0 of the path '/nix/store/hash-app' is invalid: invalid capabilities 'cap_no_such_thing=+ep': ")
+	xattrs = map[string]string{"security.capability": "cap_net_bind_service=+ep"}
+	assert.Nil(t, ValidatePermPaths([]types.PermPath{{Path: "/nix/store/hash-app", Regex: ".*", Xattrs: xattrs}}))
+}
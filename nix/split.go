@@ -0,0 +1,159 @@
+package nix
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/nlewo/nix2container/types"
+)
+
+// tarBlockSize is the size of a tar header and the unit of the size
+// of the file contents in a tar stream.
+const tarBlockSize = 512
+
+// splitPaths splits paths whose layer, of size bytes, is bigger than
+// maxLayerSize. Paths are packed, in their order, in groups smaller
+// than maxLayerSize. A single path is replaced by the files of its
+// directory, which are split again. The directory itself is added
+// without its files to each group, to keep its mode and its perms in
+// all layers: these directories lead the groups of files.
+//
+// The size of each path is estimated once from the size of its files
+// (see tarSizes), scaled to the size of the layer to take the
+// compression into account. The returned groups can then still be too
+// big: they are split again by the caller.
+func splitPaths(paths types.Paths, size, maxLayerSize int64) ([]types.Paths, error) {
+	var dirs types.Paths
+	for len(paths) > 0 && paths[0].DirectoryOnly {
+		dirs = append(dirs, paths[0])
+		paths = paths[1:]
+	}
+	sizes, err := tarSizes(paths)
+	if err != nil {
+		return nil, err
+	}
+	var total int64
+	for _, p := range paths {
+		total += sizes[filepath.Clean(p.Path)]
+	}
+	ratio := 1.0
+	if total > 0 {
+		ratio = float64(size) / float64(total)
+	}
+	sizeOf := func(p types.Path) int64 {
+		return int64(float64(sizes[filepath.Clean(p.Path)]) * ratio)
+	}
+	return splitSizedPaths(dirs, paths, sizeOf, maxLayerSize)
+}
+
+// splitSizedPaths splits paths, whose sizes are given by sizeOf, and
+// adds dirs to each group (see splitPaths).
+func splitSizedPaths(dirs, paths types.Paths, sizeOf func(types.Path) int64, maxLayerSize int64) ([]types.Paths, error) {
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("the layer of the directories %v is bigger than the maximum layer size (%d bytes) and can not be split", dirs, maxLayerSize)
+	}
+	if len(paths) == 1 {
+		children, err := subPaths(paths[0])
+		if err != nil {
+			return nil, err
+		}
+		if len(children) == 0 {
+			return nil, fmt.Errorf("the layer of the path '%s' is bigger than the maximum layer size (%d bytes) and can not be split", paths[0].Path, maxLayerSize)
+		}
+		dir := paths[0]
+		dir.DirectoryOnly = true
+		dir.SplitFrom = children[0].SplitFrom
+		return splitSizedPaths(append(slices.Clone(dirs), dir), children, sizeOf, maxLayerSize)
+	}
+
+	var groups []types.Paths
+	var current types.Paths
+	var currentSize int64
+	for _, p := range paths {
+		size := sizeOf(p)
+		if len(current) > 0 && currentSize+size > maxLayerSize {
+			groups = append(groups, current)
+			current = nil
+			currentSize = 0
+		}
+		current = append(current, p)
+		currentSize += size
+	}
+	groups = append(groups, current)
+
+	// The sum of the path sizes is smaller than the layer size:
+	// each path gets its own layer.
+	if len(groups) == 1 {
+		groups = make([]types.Paths, len(paths))
+		for i, p := range paths {
+			groups[i] = types.Paths{p}
+		}
+	}
+	for i, group := range groups {
+		groups[i] = append(slices.Clone(dirs), group...)
+	}
+	return groups, nil
+}
+
+// tarSizes walks paths once and returns the size, in an uncompressed
+// tar stream, of each of their files and directories, a directory
+// including its files. The files are not read: the size of a file is
+// its tar header and its content rounded to the tar block size.
+func tarSizes(paths types.Paths) (map[string]int64, error) {
+	sizes := make(map[string]int64)
+	for _, p := range paths {
+		root := filepath.Clean(p.Path)
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return fmt.Errorf("failed accessing path %q: %v", path, err)
+			}
+			size := int64(tarBlockSize)
+			if info.Mode().IsRegular() {
+				size += (info.Size() + tarBlockSize - 1) / tarBlockSize * tarBlockSize
+			}
+			for dir := path; ; dir = filepath.Dir(dir) {
+				sizes[dir] += size
+				if dir == root {
+					break
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sizes, nil
+}
+
+// subPaths returns the files of the directory path, sorted by name,
+// with the options of path. They are recorded as split from the store
+// path of path. It returns nil if path is not a directory.
+func subPaths(path types.Path) (types.Paths, error) {
+	info, err := os.Lstat(path.Path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, nil
+	}
+	entries, err := os.ReadDir(path.Path)
+	if err != nil {
+		return nil, err
+	}
+	splitFrom := path.SplitFrom
+	if splitFrom == "" {
+		splitFrom = path.Path
+	}
+	paths := make(types.Paths, len(entries))
+	for i, entry := range entries {
+		paths[i] = types.Path{
+			Path:      filepath.Join(path.Path, entry.Name()),
+			Options:   path.Options,
+			SplitFrom: splitFrom,
+		}
+	}
+	return paths, nil
+}
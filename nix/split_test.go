@@ -0,0 +1,164 @@
+package nix
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nlewo/nix2container/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewLayersMaxLayerSize(t *testing.T) {
+	dir := t.TempDir()
+	big := filepath.Join(dir, "big")
+	small := filepath.Join(dir, "small")
+	for _, file := range []string{"big/a", "big/b", "big/sub/c", "small"} {
+		path := filepath.Join(dir, file)
+		assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+		size := 4000
+		if file == "small" {
+			size = 100
+		}
+		assert.Nil(t, os.WriteFile(path, []byte(strings.Repeat("x", size)), 0644))
+	}
+
+	// The maximum layer size allows a single file per layer
+	_, _, oneFileSize, err := TarPathsSum(types.Paths{{Path: filepath.Join(big, "a")}}, nil, nil, nil, false, CompressionNone)
+	assert.Nil(t, err)
+	maxLayerSize := oneFileSize + 4096
+
+	layers, _, err := NewLayers([]string{big, small}, LayerOptions{MaxLayerSize: maxLayerSize})
+	assert.Nil(t, err)
+	var paths []types.Paths
+	for _, layer := range layers {
+		assert.LessOrEqual(t, layer.Size, maxLayerSize)
+		paths = append(paths, layer.Paths)
+	}
+	// The big directory is added without its files to each layer
+	bigDir := types.Path{Path: big, SplitFrom: big, DirectoryOnly: true}
+	expected := []types.Paths{
+		{bigDir, {Path: filepath.Join(big, "a"), SplitFrom: big}},
+		{bigDir, {Path: filepath.Join(big, "b"), SplitFrom: big}},
+		{bigDir, {Path: filepath.Join(big, "sub"), SplitFrom: big}},
+		{{Path: small}},
+	}
+	assert.Equal(t, expected, paths)
+
+	// The big store path is considered as present in the layers
+	assert.True(t, isPathInLayers(layers, types.Path{Path: big}))
+	assert.False(t, isPathInLayers(layers, types.Path{Path: filepath.Join(dir, "bi")}))
+	// Only pieces of a split store path are considered
+	layers = []types.Layer{{Paths: types.Paths{{Path: filepath.Join(big, "a")}}}}
+	assert.False(t, isPathInLayers(layers, types.Path{Path: big}))
+
+	// A file can not be split
+	_, _, err = NewLayers([]string{filepath.Join(big, "a")}, LayerOptions{MaxLayerSize: oneFileSize - 1})
+	assert.ErrorContains(t, err, "can not be split")
+}
+
+func TestNewLayersMaxLayerSizeDirectory(t *testing.T) {
+	dir := t.TempDir()
+	big := filepath.Join(dir, "big")
+	assert.Nil(t, os.Mkdir(big, 0750))
+	for _, file := range []string{"a", "b"} {
+		assert.Nil(t, os.WriteFile(filepath.Join(big, file), []byte(strings.Repeat("x", 4000)), 0644))
+	}
+	perms := []types.PermPath{{Path: big, Regex: "/big$", Uid: 1000}}
+	layers, _, err := NewLayers([]string{big}, LayerOptions{MaxLayerSize: 8192, Perms: perms})
+	assert.Nil(t, err)
+	assert.Len(t, layers, 2)
+
+	// The mode and the perms of the split directory are kept in
+	// each layer
+	for _, layer := range layers {
+		reader := TarPaths(layer.Paths, nil, nil, nil, false)
+		defer reader.Close() // nolint: errcheck
+		tr := tar.NewReader(reader)
+		var headers []string
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			assert.Nil(t, err)
+			if strings.HasPrefix(hdr.Name, big) {
+				headers = append(headers, fmt.Sprintf("%s %o %d", strings.TrimPrefix(hdr.Name, dir), hdr.Mode, hdr.Uid))
+			}
+		}
+		assert.Equal(t, "/big 750 1000", headers[0])
+		assert.Len(t, headers, 2)
+	}
+}
+
+func TestNewLayersMaxLayerSizeSplitAgain(t *testing.T) {
+	// Zeros are compressed while random bytes are not: the sizes of
+	// the random files, estimated with the compression ratio of the
+	// whole store path, are then too small.
+	dir := t.TempDir()
+	random := rand.New(rand.NewSource(1))
+	for _, file := range []string{"a", "b", "c/1", "c/2", "c/3"} {
+		path := filepath.Join(dir, file)
+		assert.Nil(t, os.MkdirAll(filepath.Dir(path), 0755))
+		content := make([]byte, 64*1024)
+		if strings.HasPrefix(file, "c/") {
+			content = make([]byte, 16*1024)
+			random.Read(content)
+		}
+		assert.Nil(t, os.WriteFile(path, content, 0644))
+	}
+	maxLayerSize := int64(40 * 1024)
+	layers, _, err := NewLayers([]string{dir}, LayerOptions{MaxLayerSize: maxLayerSize, Compression: CompressionGzip})
+	assert.Nil(t, err)
+	var paths []types.Paths
+	for _, layer := range layers {
+		assert.LessOrEqual(t, layer.Size, maxLayerSize)
+		paths = append(paths, layer.Paths)
+	}
+	// The group of c is too big once compressed and is split again
+	rootDir := types.Path{Path: dir, SplitFrom: dir, DirectoryOnly: true}
+	cDir := types.Path{Path: filepath.Join(dir, "c"), SplitFrom: dir, DirectoryOnly: true}
+	expected := []types.Paths{
+		{rootDir, {Path: filepath.Join(dir, "a"), SplitFrom: dir}, {Path: filepath.Join(dir, "b"), SplitFrom: dir}},
+		{rootDir, cDir, {Path: filepath.Join(dir, "c", "1"), SplitFrom: dir}, {Path: filepath.Join(dir, "c", "2"), SplitFrom: dir}},
+		{rootDir, cDir, {Path: filepath.Join(dir, "c", "3"), SplitFrom: dir}},
+	}
+	assert.Equal(t, expected, paths)
+}
+
+func TestNewLayersNonReproducibleMaxLayerSize(t *testing.T) {
+	tmpDir := t.TempDir()
+	paths := []string{"../data/layer1", "../data/tar-directory"}
+	layers, _, err := NewLayersNonReproducible(paths, tmpDir, LayerOptions{MaxLayerSize: 4096})
+	assert.Nil(t, err)
+	assert.Len(t, layers, 2)
+	// The tarball of the too big layer has been removed
+	entries, err := os.ReadDir(tmpDir)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+}
+
+func TestTarSizes(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.MkdirAll(filepath.Join(dir, "sub"), 0755))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "sub", "a"), []byte(strings.Repeat("x", 4000)), 0644))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "b"), nil, 0644))
+	assert.Nil(t, os.Symlink("b", filepath.Join(dir, "c")))
+
+	sizes, err := tarSizes(types.Paths{{Path: dir + "/"}})
+	assert.Nil(t, err)
+	expected := map[string]int64{
+		// The headers of the 5 files and the 8 blocks of a
+		dir:                            5*512 + 4096,
+		filepath.Join(dir, "sub"):      512 + 512 + 4096,
+		filepath.Join(dir, "sub", "a"): 512 + 4096,
+		filepath.Join(dir, "b"):        512,
+		filepath.Join(dir, "c"):        512,
+	}
+	assert.Equal(t, expected, sizes)
+}
@@ -2,11 +2,15 @@ package nix
 
 import (
 	"archive/tar"
+	"context"
 	"fmt"
 	"io"
+	"maps"
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
+	"sort"
 	"time"
 
 	"github.com/nlewo/nix2container/types"
@@ -14,45 +18,106 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-func TarPathsWrite(paths types.Paths, destinationDirectory string) (string, digest.Digest, int64, error) {
+// TarPathsWrite writes the tar stream of paths, entries and
+// deletions, compressed with compression, to a file in
+// destinationDirectory. The directory perms apply to the directories
+// which are not in the Nix store (see createDirectory). If hardLinks
+// is true, hard links are preserved (see appendFileToTar). It returns the path
+// of this file, the digest and the size of the written blob and the
+// digest of the uncompressed tar stream (the layer DiffID).
+func TarPathsWrite(paths types.Paths, entries []types.Entry, deletions []types.Deletion, directoryPerms []types.Perm, hardLinks bool, destinationDirectory string, compression Compression) (string, digest.Digest, digest.Digest, int64, error) {
+	return tarPathsWrite(context.Background(), paths, entries, deletions, directoryPerms, hardLinks, destinationDirectory, compression)
+}
+
+// tarPathsWrite writes a layer tarball (see TarPathsWrite) until ctx
+// is done. The file is removed if an error occurs.
+func tarPathsWrite(ctx context.Context, paths types.Paths, entries []types.Entry, deletions []types.Deletion, directoryPerms []types.Perm, hardLinks bool, destinationDirectory string, compression Compression) (string, digest.Digest, digest.Digest, int64, error) {
 	f, err := os.CreateTemp(destinationDirectory, "")
 	if err != nil {
-		return "", "", 0, err
+		return "", "", "", 0, err
 	}
-	defer f.Close() // nolint: errcheck
-	reader := TarPaths(paths)
-	defer reader.Close() // nolint: errcheck
+	defer os.Remove(f.Name()) // nolint: errcheck
+	defer f.Close()           // nolint: errcheck
 
-	r := io.TeeReader(reader, f)
-
-	digester := digest.Canonical.Digester()
-	size, err := io.Copy(digester.Hash(), r)
+	digest, diffID, size, err := sumTarPaths(ctx, f, paths, entries, deletions, directoryPerms, hardLinks, compression)
 	if err != nil {
-		return "", "", 0, err
+		return "", "", "", 0, err
 	}
-	digest := digester.Digest()
 
-	filename := destinationDirectory + "/" + digest.Encoded() + ".tar"
+	filename := destinationDirectory + "/" + digest.Encoded() + compression.extension()
 	err = os.Rename(f.Name(), filename)
 	if err != nil {
-		return "", "", 0, err
+		return "", "", "", 0, err
 	}
-	return filename, digest, size, nil
+	return filename, digest, diffID, size, nil
 }
 
-func TarPathsSum(paths types.Paths) (digest.Digest, int64, error) {
-	reader := TarPaths(paths)
+// TarPathsSum computes the digest and the size of the tar stream of
+// paths, entries and deletions compressed with compression, as well
+// as the digest of the uncompressed tar stream (the layer DiffID). The
+// directory perms apply to the directories which are not in the Nix
+// store. If hardLinks is true, hard links are preserved.
+func TarPathsSum(paths types.Paths, entries []types.Entry, deletions []types.Deletion, directoryPerms []types.Perm, hardLinks bool, compression Compression) (digest.Digest, digest.Digest, int64, error) {
+	return sumTarPaths(context.Background(), nil, paths, entries, deletions, directoryPerms, hardLinks, compression)
+}
+
+// sumTarPaths computes the digests and the size of the tar stream of
+// paths, entries and deletions compressed with compression (see
+// TarPathsSum). If w is not nil, the compressed stream is also
+// written to w. The tar stream is not read anymore once ctx is done.
+func sumTarPaths(ctx context.Context, w io.Writer, paths types.Paths, entries []types.Entry, deletions []types.Deletion, directoryPerms []types.Perm, hardLinks bool, compression Compression) (digest.Digest, digest.Digest, int64, error) {
+	reader := TarPaths(paths, entries, deletions, directoryPerms, hardLinks)
 	defer reader.Close() // nolint: errcheck
 
-	digester := digest.Canonical.Digester()
-	size, err := io.Copy(digester.Hash(), reader)
+	blobDigester := digest.Canonical.Digester()
+	blobCounter := &countingWriter{}
+	writers := []io.Writer{blobDigester.Hash(), blobCounter}
+	if w != nil {
+		writers = append(writers, w)
+	}
+	compressor, err := newCompressor(io.MultiWriter(writers...), compression)
 	if err != nil {
-		return "", 0, err
+		return "", "", 0, err
+	}
+
+	diffIDDigester := digest.Canonical.Digester()
+	_, err = io.Copy(io.MultiWriter(compressor, diffIDDigester.Hash()), contextReader{ctx: ctx, r: reader})
+	if err != nil {
+		return "", "", 0, err
 	}
-	return digester.Digest(), size, nil
+	if err := compressor.Close(); err != nil {
+		return "", "", 0, err
+	}
+	return blobDigester.Digest(), diffIDDigester.Digest(), blobCounter.size, nil
+}
+
+// contextReader reads from r until ctx is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
 }
 
-func createDirectory(tw *tar.Writer, path string) error {
+func (c contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// countingWriter counts the number of bytes written to it.
+type countingWriter struct {
+	size int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.size += int64(len(p))
+	return len(p), nil
+}
+
+// createDirectory writes a directory which is not in the Nix store,
+// such as /nix/store. It is owned by root with the mode 0755, unless
+// a perm of opts matches its path.
+func createDirectory(tw *tar.Writer, path string, opts *pathOptions) error {
 	epoch := time.Date(1970, 01, 01, 0, 0, 0, 0, time.UTC)
 	hdr := &tar.Header{
 		Name:     path,
@@ -65,6 +130,12 @@ func createDirectory(tw *tar.Writer, path string) error {
 		Mode:       0755,
 	}
 
+	if opts != nil {
+		if err := applyPerms(hdr, opts, path, path); err != nil {
+			return err
+		}
+	}
+
 	hdr.ModTime = time.Date(1970, 01, 01, 0, 0, 1, 0, time.UTC)
 
 	if err := tw.WriteHeader(hdr); err != nil {
@@ -73,7 +144,131 @@ func createDirectory(tw *tar.Writer, path string) error {
 	return nil
 }
 
-func appendFileToTar(tw *tar.Writer, srcPath, dstPath string, info os.FileInfo, opts *types.PathOptions) error {
+// permMatches returns true if perm, whose regex is re, applies to the
+// file of hdr, whose mode is mode before applying perms. The regex is
+// matched against the source path, unless the match of perm is
+// "destination", and its type restricts the kind of files it applies
+// to. The match and the type have been checked by compilePerm.
+func permMatches(perm types.Perm, re *regexp.Regexp, hdr *tar.Header, mode int64, srcPath, dstPath string) bool {
+	path := srcPath
+	if perm.Match == "destination" {
+		path = dstPath
+	}
+	switch perm.Type {
+	case "file":
+		if hdr.Typeflag != tar.TypeReg {
+			return false
+		}
+	case "dir":
+		if hdr.Typeflag != tar.TypeDir {
+			return false
+		}
+	case "symlink":
+		if hdr.Typeflag != tar.TypeSymlink {
+			return false
+		}
+	case "executable":
+		if hdr.Typeflag != tar.TypeReg || mode&0o111 == 0 {
+			return false
+		}
+	}
+	return re.Match([]byte(path))
+}
+
+// applyPerms sets the owners, the mode and the extended attributes
+// of the perms of opts matching the file (see permMatches) to hdr.
+func applyPerms(hdr *tar.Header, opts *pathOptions, srcPath, dstPath string) error {
+	mode := hdr.Mode
+	for i, perm := range opts.Perms {
+		if !permMatches(perm, opts.perms[i], hdr, mode, srcPath, dstPath) {
+			continue
+		}
+		var err error
+		// Zero value is same as root ID (0)
+		hdr.Uid = perm.Uid
+		hdr.Gid = perm.Gid
+
+		if perm.Uname != "" {
+			hdr.Uname = perm.Uname
+		}
+
+		if perm.Gname != "" {
+			hdr.Gname = perm.Gname
+		}
+
+		if perm.Mode != "" {
+			hdr.Mode, err = applyMode(perm.Mode, hdr.Mode, hdr.Typeflag == tar.TypeDir)
+			if err != nil {
+				return fmt.Errorf("invalid mode '%s' of the file '%s': %w", perm.Mode, srcPath, err)
+			}
+		}
+
+		for name, value := range perm.Xattrs {
+			if name == capabilityXattr {
+				value, err = encodeCapabilities(value)
+				if err != nil {
+					return fmt.Errorf("invalid capabilities '%s' of the file '%s': %w", perm.Xattrs[name], srcPath, err)
+				}
+			}
+			if hdr.PAXRecords == nil {
+				hdr.PAXRecords = make(map[string]string)
+			}
+			hdr.PAXRecords["SCHILY.xattr."+name] = value
+		}
+	}
+	return nil
+}
+
+// appendWhiteoutToTar writes an empty whiteout file.
+func appendWhiteoutToTar(tw *tar.Writer, path string) error {
+	epoch := time.Date(1970, 01, 01, 0, 0, 0, 0, time.UTC)
+	hdr := &tar.Header{
+		Name:     path,
+		Typeflag: tar.TypeReg,
+		Uid:      0, Gid: 0,
+		Uname: "root", Gname: "root",
+		ModTime:    time.Date(1970, 01, 01, 0, 0, 1, 0, time.UTC),
+		AccessTime: epoch,
+		ChangeTime: epoch,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("could not write hdr '%#v', got error '%s'", hdr, err.Error())
+	}
+	return nil
+}
+
+// fileID identifies a file on the filesystem.
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// linkTarget is the first occurrence, in the tar stream, of a file
+// having several hard links.
+type linkTarget struct {
+	// The destination path, which is the name of the tar header
+	dstPath string
+	hdr     *tar.Header
+}
+
+// linkTargets holds the link targets of the files having several hard
+// links.
+type linkTargets map[fileID]linkTarget
+
+// sameMetadata returns true if both headers have the same mode,
+// owners and extended attributes: a hard link can only be used if the
+// permissions of the linked file are the same.
+func sameMetadata(a, b *tar.Header) bool {
+	return a.Mode == b.Mode && a.Uid == b.Uid && a.Gid == b.Gid && a.Uname == b.Uname && a.Gname == b.Gname && maps.Equal(a.PAXRecords, b.PAXRecords)
+}
+
+// appendFileToTar writes a file to the tar stream. If links is not
+// nil, a file sharing its device and inode with a file already
+// written to the tar stream is written as a hard link to this file,
+// if they have the same permissions. Since the tar stream is sorted by
+// destination path, links always point to the first occurrence by
+// destination path.
+func appendFileToTar(tw *tar.Writer, srcPath, dstPath string, info os.FileInfo, opts *pathOptions, links linkTargets) error {
 	var link string
 	var err error
 	if info.Mode()&os.ModeSymlink != 0 {
@@ -101,28 +296,8 @@ func appendFileToTar(tw *tar.Writer, srcPath, dstPath string, info os.FileInfo,
 	}
 
 	if opts != nil {
-		for _, perms := range opts.Perms {
-			re := regexp.MustCompile(perms.Regex)
-			if re.Match([]byte(srcPath)) {
-				// Zero value is same as root ID (0)
-				hdr.Uid = perms.Uid
-				hdr.Gid = perms.Gid
-
-				if perms.Uname != "" {
-					hdr.Uname = perms.Uname
-				}
-
-				if perms.Gname != "" {
-					hdr.Gname = perms.Gname
-				}
-
-				if perms.Mode != "" {
-					_, err := fmt.Sscanf(perms.Mode, "%o", &hdr.Mode)
-					if err != nil {
-						return err
-					}
-				}
-			}
+		if err := applyPerms(hdr, opts, srcPath, dstPath); err != nil {
+			return err
 		}
 	}
 
@@ -130,6 +305,22 @@ func appendFileToTar(tw *tar.Writer, srcPath, dstPath string, info os.FileInfo,
 	hdr.AccessTime = time.Date(1970, 01, 01, 0, 0, 0, 0, time.UTC)
 	hdr.ChangeTime = time.Date(1970, 01, 01, 0, 0, 0, 0, time.UTC)
 
+	if links != nil && hdr.Typeflag == tar.TypeReg {
+		if id, ok := getFileID(info); ok {
+			if first, ok := links[id]; !ok {
+				links[id] = linkTarget{dstPath: dstPath, hdr: hdr}
+			} else if sameMetadata(first.hdr, hdr) {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = first.dstPath
+				hdr.Size = 0
+				if err := tw.WriteHeader(hdr); err != nil {
+					return fmt.Errorf("could not write hdr '%#v', got error '%s'", hdr, err.Error())
+				}
+				return nil
+			}
+		}
+	}
+
 	if err := tw.WriteHeader(hdr); err != nil {
 		return fmt.Errorf("could not write hdr '%#v', got error '%s'", hdr, err.Error())
 	}
@@ -150,26 +341,55 @@ func appendFileToTar(tw *tar.Writer, srcPath, dstPath string, info os.FileInfo,
 }
 
 // TarPaths takes a list of paths and return a ReadCloser to the tar
-// archive. If an error occurs, the ReadCloser is closed with the error.
-func TarPaths(paths types.Paths) io.ReadCloser {
+// archive. Entries are written as files which don't exist in the Nix
+// store and deletions as whiteout files. The directory perms, matched
+// against the destination path, apply to the directories which are
+// not in the Nix store, such as /nix/store. If hardLinks is
+// true, files sharing their inode are written as hard links. If an
+// error occurs, the ReadCloser is closed with the error.
+func TarPaths(paths types.Paths, entries []types.Entry, deletions []types.Deletion, directoryPerms []types.Perm, hardLinks bool) io.ReadCloser {
 	r, w := io.Pipe()
 	tw := tar.NewWriter(w)
 	graph := initGraph()
 
 	go func() {
 		defer w.Close() // nolint: errcheck
+		var directoryOptions *pathOptions
+		var err error
+		if len(directoryPerms) > 0 {
+			directoryOptions, err = compilePathOptions(&types.PathOptions{Perms: directoryPerms})
+			if err != nil {
+				if err := w.CloseWithError(fmt.Errorf("invalid directory perms: %w", err)); err != nil {
+					return
+				}
+				return
+			}
+		}
 		// First, we build a graph representing all files that
 		// has to be added to the layer. This graph allows to
 		// transform the file tree without having to write
 		// anything to the tar stream.
 		for _, path := range paths {
-			options := path.Options
-			err := filepath.Walk(path.Path, func(path string, info os.FileInfo, err error) error {
+			options, err := compilePathOptions(path.Options)
+			if err != nil {
+				if err := w.CloseWithError(fmt.Errorf("invalid options of the path '%s': %w", path.Path, err)); err != nil {
+					return
+				}
+				return
+			}
+			directoryOnly := path.DirectoryOnly
+			err = filepath.Walk(path.Path, func(path string, info os.FileInfo, err error) error {
 				if err != nil {
 					return fmt.Errorf("failed accessing path %q: %v", path, err)
 				}
 				logrus.Debugf("Walking filesystem: %s", path)
-				return addFileToGraph(graph, path, &info, options)
+				if err := addFileToGraph(graph, path, &info, options); err != nil {
+					return err
+				}
+				if directoryOnly && info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
 			})
 			if err != nil {
 				if err := w.CloseWithError(err); err != nil {
@@ -178,15 +398,47 @@ func TarPaths(paths types.Paths) io.ReadCloser {
 				return
 			}
 		}
+		for _, entry := range entries {
+			if err := addEntryToGraph(graph, entry); err != nil {
+				if err := w.CloseWithError(err); err != nil {
+					return
+				}
+				return
+			}
+		}
+		// Deletions are added once all files are in the graph
+		// to detect collisions.
+		sorted := slices.Clone(deletions)
+		sort.Slice(sorted, func(i, j int) bool {
+			return sorted[i].Path < sorted[j].Path
+		})
+		for _, deletion := range sorted {
+			if err := addDeletionToGraph(graph, deletion); err != nil {
+				if err := w.CloseWithError(err); err != nil {
+					return
+				}
+				return
+			}
+		}
 
 		// Once the graph of file has been built, it is walked
 		// in order to generate the tar stream.
-		err := walkGraph(graph, func(srcPath, dstPath string, info *os.FileInfo, options *types.PathOptions) error {
+		var links linkTargets
+		if hardLinks {
+			links = make(linkTargets)
+		}
+		err = walkGraph(graph, directoryOptions, func(srcPath, dstPath string, info *os.FileInfo, options *pathOptions) error {
 			// This file is a directory
 			if info == nil {
-				return createDirectory(tw, dstPath)
+				return createDirectory(tw, dstPath, options)
+			}
+			if _, ok := (*info).(whiteoutFileInfo); ok {
+				return appendWhiteoutToTar(tw, dstPath)
+			}
+			if entry, ok := (*info).(entryFileInfo); ok {
+				return appendEntryToTar(tw, dstPath, entry)
 			}
-			return appendFileToTar(tw, srcPath, dstPath, *info, options)
+			return appendFileToTar(tw, srcPath, dstPath, *info, options, links)
 		})
 		if err != nil {
 			if err := w.CloseWithError(err); err != nil {
@@ -1,6 +1,13 @@
 package nix
 
 import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
 	"testing"
 
 	"github.com/nlewo/nix2container/types"
@@ -11,7 +18,7 @@ func TestTar(t *testing.T) {
 	path := types.Path{
 		Path: "../data/tar-directory",
 	}
-	digest, size, err := TarPathsSum(types.Paths{path})
+	digest, _, size, err := TarPathsSum(types.Paths{path}, nil, nil, nil, false, CompressionNone)
 	if err != nil {
 		t.Fatalf("%v", err)
 	}
@@ -42,3 +49,333 @@ func TestRemoveNixCaseHackSuffix(t *testing.T) {
 		t.Errorf("%s should be %s", ret, expected)
 	}
 }
+
+func TestTarDeletions(t *testing.T) {
+	deletions := []types.Deletion{
+		{Path: "/var/cache", Opaque: true},
+		{Path: "/etc/motd"},
+	}
+	reader := TarPaths(nil, nil, deletions, nil, false)
+	defer reader.Close() // nolint: errcheck
+	tr := tar.NewReader(reader)
+	var entries []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		entries = append(entries, fmt.Sprintf("%c %s %d", hdr.Typeflag, hdr.Name, hdr.Size))
+	}
+	expected := []string{
+		"5 / 0",
+		"5 /etc 0",
+		"0 /etc/.wh.motd 0",
+		"5 /var 0",
+		"5 /var/cache 0",
+		"0 /var/cache/.wh..wh..opq 0",
+	}
+	assert.Equal(t, expected, entries)
+
+	// A deleted file can not be added by the same layer
+	paths := types.Paths{{
+		Path: "../data/tar-directory",
+		Options: &types.PathOptions{
+			Rewrites: []types.Rewrite{{Regex: "^../data/tar-directory", Repl: "/etc"}},
+		},
+	}}
+	_, _, _, err := TarPathsSum(paths, nil, []types.Deletion{{Path: "/etc/file1"}}, nil, false, CompressionNone)
+	assert.EqualError(t, err, "the deleted path '/etc/file1' collides with files added to the layer")
+}
+
+func tarEntries(t *testing.T, reader io.Reader) (entries []string) {
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		assert.Nil(t, err)
+		entries = append(entries, fmt.Sprintf("%c %s %d %s %o", hdr.Typeflag, filepath.Base(hdr.Name), hdr.Size, filepath.Base(hdr.Linkname), hdr.Mode))
+	}
+}
+
+func TestTarHardLinks(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "z"), []byte("content"), 0644))
+	assert.Nil(t, os.Link(filepath.Join(dir, "z"), filepath.Join(dir, "a")))
+	assert.Nil(t, os.Link(filepath.Join(dir, "z"), filepath.Join(dir, "m")))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "b"), []byte("content"), 0644))
+	paths := types.Paths{{Path: dir}}
+
+	// The first file by destination path is the link target
+	reader := TarPaths(paths, nil, nil, nil, true)
+	defer reader.Close() // nolint: errcheck
+	expected := []string{
+		"0 a 7 . 644",
+		"0 b 7 . 644",
+		"1 m 0 a 644",
+		"1 z 0 a 644",
+	}
+	assert.Equal(t, expected, tarEntries(t, reader)[len(splitPath(dir)):])
+
+	// Hard links are not preserved by default
+	reader = TarPaths(paths, nil, nil, nil, false)
+	defer reader.Close() // nolint: errcheck
+	expected = []string{
+		"0 a 7 . 644",
+		"0 b 7 . 644",
+		"0 m 7 . 644",
+		"0 z 7 . 644",
+	}
+	assert.Equal(t, expected, tarEntries(t, reader)[len(splitPath(dir)):])
+
+	// A link with other permissions than its target is written as
+	// a regular file
+	paths[0].Options = &types.PathOptions{
+		Perms: []types.Perm{{Regex: "/m$", Mode: "0600"}},
+	}
+	reader = TarPaths(paths, nil, nil, nil, true)
+	defer reader.Close() // nolint: errcheck
+	expected = []string{
+		"0 a 7 . 644",
+		"0 b 7 . 644",
+		"0 m 7 . 600",
+		"1 z 0 a 644",
+	}
+	assert.Equal(t, expected, tarEntries(t, reader)[len(splitPath(dir)):])
+}
+
+func TestTarHardLinksRewrite(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "z"), []byte("content"), 0644))
+	assert.Nil(t, os.Link(filepath.Join(dir, "z"), filepath.Join(dir, "a")))
+	paths := types.Paths{{
+		Path: dir,
+		Options: &types.PathOptions{
+			Rewrites: []types.Rewrite{{Regex: "^" + dir, Repl: "/etc"}},
+		},
+	}}
+
+	// The link name is the rewritten name of its target
+	reader := TarPaths(paths, nil, nil, nil, true)
+	defer reader.Close() // nolint: errcheck
+	tr := tar.NewReader(reader)
+	names := make(map[string]string)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		names[hdr.Name] = hdr.Linkname
+	}
+	assert.Equal(t, map[string]string{"/": "", "/etc": "", "/etc/a": "", "/etc/z": "/etc/a"}, names)
+}
+
+func TestTarXattrs(t *testing.T) {
+	paths := types.Paths{{
+		Path: "../data/layer1/file1",
+		Options: &types.PathOptions{
+			Perms: []types.Perm{{
+				Regex: "file1",
+				Xattrs: map[string]string{
+					"security.capability": "cap_net_bind_service=+ep",
+					"user.comment":        "nginx",
+				},
+			}},
+		},
+	}}
+	reader := TarPaths(paths, nil, nil, nil, false)
+	defer reader.Close() // nolint: errcheck
+	tr := tar.NewReader(reader)
+	var records map[string]string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		if hdr.Name == "../data/layer1/file1" {
+			records = hdr.PAXRecords
+		}
+	}
+	expected := map[string]string{
+		"SCHILY.xattr.security.capability": capabilityValue(0x02000001, 1<<10, 0),
+		"SCHILY.xattr.user.comment":        "nginx",
+	}
+	assert.Equal(t, expected, records)
+
+	paths[0].Options.Perms[0].Xattrs = map[string]string{"security.capability": "cap_unknown=ep"}
+	_, _, _, err := TarPathsSum(paths, nil, nil, nil, false, CompressionNone)
+	// The capabilities are checked before writing the tar stream
+	assert.EqualError(t, err, "invalid options of the path '../data/layer1/file1': the perm 0 is invalid: invalid capabilities 'cap_unknown=ep': unknown capability 'cap_unknown'")
+}
+
+func TestTarEntries(t *testing.T) {
+	entries := []types.Entry{
+		{Type: "directory", Path: "/tmp", Mode: "1777"},
+		{Type: "symlink", Path: "/bin/sh", Target: "/nix/store/bash/bin/bash"},
+		{Type: "char-device", Path: "/dev/null", Major: 1, Minor: 3},
+		{Type: "file", Path: "/etc/hostname", Content: "nix2container\n", Uid: 1000, Uname: "user"},
+		{Type: "directory", Path: "/var/run"},
+	}
+	reader := TarPaths(nil, entries, nil, nil, false)
+	defer reader.Close() // nolint: errcheck
+	tr := tar.NewReader(reader)
+	var headers []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		headers = append(headers, fmt.Sprintf("%c %s %d %s %o %d:%d %s %d", hdr.Typeflag, hdr.Name, hdr.Size, hdr.Linkname, hdr.Mode, hdr.Devmajor, hdr.Devminor, hdr.Uname, hdr.Uid))
+	}
+	expected := []string{
+		"5 / 0  755 0:0 root 0",
+		"5 /bin 0  755 0:0 root 0",
+		"2 /bin/sh 0 /nix/store/bash/bin/bash 777 0:0 root 0",
+		"5 /dev 0  755 0:0 root 0",
+		"3 /dev/null 0  666 1:3 root 0",
+		"5 /etc 0  755 0:0 root 0",
+		"0 /etc/hostname 14  644 0:0 user 1000",
+		"5 /tmp 0  1777 0:0 root 0",
+		"5 /var 0  755 0:0 root 0",
+		"5 /var/run 0  755 0:0 root 0",
+	}
+	assert.Equal(t, expected, headers)
+
+	// Entries collide with files of the Nix store as other files
+	paths := types.Paths{{
+		Path: "../data/tar-directory",
+		Options: &types.PathOptions{
+			Rewrites: []types.Rewrite{{Regex: "^../data/tar-directory", Repl: "/etc"}},
+		},
+	}}
+	_, _, _, err := TarPathsSum(paths, []types.Entry{{Type: "directory", Path: "/etc/file1"}}, nil, nil, false, CompressionNone)
+	assert.ErrorContains(t, err, "the file '/etc/file1' already exists in the graph with mode")
+	_, _, _, err = TarPathsSum(paths, []types.Entry{{Type: "file", Path: "/etc"}}, nil, nil, false, CompressionNone)
+	assert.ErrorContains(t, err, "while it is added again with mode '-rw-r--r--' by '/etc'")
+	_, _, _, err = TarPathsSum(nil, []types.Entry{{Type: "file", Path: "/etc"}, {Type: "file", Path: "/etc/passwd"}}, nil, nil, false, CompressionNone)
+	assert.EqualError(t, err, "the file '/etc/passwd' added by '/etc/passwd' is in '/etc' which is not a directory")
+
+	_, _, _, err = TarPathsSum(nil, []types.Entry{{Type: "fifo", Path: "/run/fifo"}}, nil, nil, false, CompressionNone)
+	assert.EqualError(t, err, "the entry '/run/fifo' has the unsupported type 'fifo' (expected file, directory, symlink, char-device or block-device)")
+	_, _, _, err = TarPathsSum(nil, []types.Entry{{Type: "symlink", Path: "/bin/sh"}}, nil, nil, false, CompressionNone)
+	assert.EqualError(t, err, "the symlink entry '/bin/sh' has no target")
+	_, _, _, err = TarPathsSum(nil, []types.Entry{{Type: "file", Path: "/etc/shadow", Mode: "0640x"}}, nil, nil, false, CompressionNone)
+	assert.EqualError(t, err, "invalid mode '0640x' of the entry '/etc/shadow': the mode '0640x' is not an octal number")
+	_, _, _, err = TarPathsSum(nil, []types.Entry{{Type: "file", Path: "/etc/shadow", Mode: "17777"}}, nil, nil, false, CompressionNone)
+	assert.EqualError(t, err, "invalid mode '17777' of the entry '/etc/shadow': the octal mode '17777' is out of range")
+}
+
+func TestTarDirectoryPerms(t *testing.T) {
+	entries := []types.Entry{{Type: "file", Path: "/home/app/.profile"}}
+	directoryPerms := []types.Perm{
+		{Regex: "^/home/app$", Mode: "0700", Uid: 1000, Gid: 1000, Uname: "app", Gname: "app"},
+		// Entries and files of the Nix store are not changed
+		{Regex: "^/home/app/", Mode: "0777"},
+	}
+	reader := TarPaths(nil, entries, nil, directoryPerms, false)
+	defer reader.Close() // nolint: errcheck
+	tr := tar.NewReader(reader)
+	var headers []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		headers = append(headers, fmt.Sprintf("%s %o %s:%s %d:%d", hdr.Name, hdr.Mode, hdr.Uname, hdr.Gname, hdr.Uid, hdr.Gid))
+	}
+	expected := []string{
+		"/ 755 root:root 0:0",
+		"/home 755 root:root 0:0",
+		"/home/app 700 app:app 1000:1000",
+		"/home/app/.profile 644 root:root 0:0",
+	}
+	assert.Equal(t, expected, headers)
+}
+
+func TestTarPermsMatch(t *testing.T) {
+	dir := t.TempDir()
+	assert.Nil(t, os.Chmod(dir, 0755))
+	assert.Nil(t, os.Mkdir(filepath.Join(dir, "bin"), 0755))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "bin", "run"), []byte("#!/bin/sh"), 0755))
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, "bin", "README"), []byte("run"), 0644))
+	assert.Nil(t, os.Symlink("bin", filepath.Join(dir, "lib")))
+	paths := types.Paths{{
+		Path: dir,
+		Options: &types.PathOptions{
+			Rewrites: []types.Rewrite{{Regex: "^" + regexp.QuoteMeta(dir), Repl: "/app"}},
+			Perms: []types.Perm{
+				{Regex: "^/app/", Match: "destination", Type: "executable", Uid: 1000, Uname: "app"},
+				{Regex: "^/app", Match: "destination", Type: "dir", Mode: "0700"},
+				{Regex: "/bin/README$", Mode: "0600"},
+				// The source path is matched by default
+				{Regex: "^/app/", Type: "symlink", Uid: 42, Uname: "nobody"},
+			},
+		},
+	}}
+	reader := TarPaths(paths, nil, nil, nil, false)
+	defer reader.Close() // nolint: errcheck
+	tr := tar.NewReader(reader)
+	var headers []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.Nil(t, err)
+		headers = append(headers, fmt.Sprintf("%s %o %s", hdr.Name, hdr.Mode, hdr.Uname))
+	}
+	expected := []string{
+		"/ 755 root",
+		"/app 700 root",
+		"/app/bin 700 root",
+		"/app/bin/README 600 root",
+		"/app/bin/run 755 app",
+		"/app/lib 777 root",
+	}
+	assert.Equal(t, expected, headers)
+
+	paths[0].Options.Perms = []types.Perm{{Regex: ".*", Type: "socket"}}
+	_, _, _, err := TarPathsSum(paths, nil, nil, nil, false, CompressionNone)
+	assert.EqualError(t, err, fmt.Sprintf("invalid options of the path '%s': the perm 0 is invalid: the type 'socket' is not supported (expected file, dir, symlink or executable)", dir))
+	paths[0].Options.Perms = []types.Perm{{Regex: ".*", Match: "target"}}
+	_, _, _, err = TarPathsSum(paths, nil, nil, nil, false, CompressionNone)
+	assert.EqualError(t, err, fmt.Sprintf("invalid options of the path '%s': the perm 0 is invalid: the match 'target' is not supported (expected source or destination)", dir))
+	paths[0].Options.Perms = []types.Perm{{Regex: "("}}
+	_, _, _, err = TarPathsSum(paths, nil, nil, nil, false, CompressionNone)
+	assert.EqualError(t, err, fmt.Sprintf("invalid options of the path '%s': the perm 0 is invalid: could not compile the regex '(': error parsing regexp: missing closing ): `(`", dir))
+
+	// Symbolic modes are applied to the mode of the file
+	paths[0].Options.Perms = []types.Perm{{Regex: "^/app/bin", Match: "destination", Mode: "g+w,o-rx"}}
+	reader = TarPaths(paths, nil, nil, nil, false)
+	defer reader.Close() // nolint: errcheck
+	expected = []string{
+		"5 / 0 . 755",
+		"5 app 0 . 755",
+		"5 bin 0 . 770",
+		"0 README 3 . 660",
+		"0 run 9 . 770",
+		"2 lib 0 bin 777",
+	}
+	assert.Equal(t, expected, tarEntries(t, reader))
+	paths[0].Options.Perms = []types.Perm{{Regex: "README$", Mode: "g+q"}}
+	_, _, _, err = TarPathsSum(paths, nil, nil, nil, false, CompressionNone)
+	assert.EqualError(t, err, fmt.Sprintf("invalid options of the path '%s': the perm 0 is invalid: invalid mode 'g+q': the symbolic mode 'g+q' has the unexpected permission 'q' (expected r, w, x, X, s or t)", dir))
+}
+
+func TestTarPathsWriteCanceled(t *testing.T) {
+	dir := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, _, _, err := tarPathsWrite(ctx, types.Paths{{Path: "../data/tar-directory"}}, nil, nil, nil, false, dir, CompressionGzip)
+	assert.ErrorIs(t, err, context.Canceled)
+	// The partially written blob is removed
+	files, err := os.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Len(t, files, 0)
+}
@@ -1,10 +1,8 @@
 package nix
 
 import (
-	"github.com/nlewo/nix2container/types"
 	"path"
 	"path/filepath"
-	"regexp"
 	"strings"
 )
 
@@ -36,11 +34,12 @@ func splitPath(path string) []string {
 	return parts
 }
 
-func filePathToTarPath(filepath string, options *types.PathOptions) string {
+func filePathToTarPath(filepath string, options *pathOptions) string {
 	tarPath := filepath
-	if options != nil && options.Rewrite.Regex != "" {
-		re := regexp.MustCompile(options.Rewrite.Regex)
-		tarPath = string(re.ReplaceAll([]byte(filepath), []byte(options.Rewrite.Repl)))
+	if options != nil {
+		for i, rewrite := range options.Rewrites {
+			tarPath = string(options.rewrites[i].ReplaceAll([]byte(tarPath), []byte(rewrite.Repl)))
+		}
 	}
 	return tarPath
 }
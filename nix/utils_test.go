@@ -16,15 +16,30 @@ func TestSplit(t *testing.T) {
 }
 
 func TestFilePathToTarPath(t *testing.T) {
-	pathOptions := types.PathOptions{
-		Rewrite: types.Rewrite{
+	options, err := compilePathOptions(&types.PathOptions{
+		Rewrites: []types.Rewrite{{
 			Regex: "^/nix/store/x896lxz471i4rgicjxygfh37a0appv7l-nix-database",
-			Repl:  ""},
+			Repl:  ""}},
 		Perms: []types.Perm(nil),
-	}
+	})
+	assert.Nil(t, err)
 	path := "/nix/store/x896lxz471i4rgicjxygfh37a0appv7l-nix-database"
-	tarPath := filePathToTarPath(path, &pathOptions)
-	assert.Equal(t, tarPath, "")
+	assert.Equal(t, filePathToTarPath(path, options), "")
 
 	assert.Equal(t, filePathToTarPath("/", nil), "/")
+
+	// Rewrites are applied in order
+	options, err = compilePathOptions(&types.PathOptions{
+		Rewrites: []types.Rewrite{
+			{Regex: "^/nix/store/[^/]*-app", Repl: ""},
+			{Regex: "^/share/", Repl: "/usr/share/"},
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "/usr/share/app/README", filePathToTarPath("/nix/store/x896lxz471i4rgicjxygfh37a0appv7l-app/share/app/README", options))
+	assert.Equal(t, "/bin/app", filePathToTarPath("/nix/store/x896lxz471i4rgicjxygfh37a0appv7l-app/bin/app", options))
+
+	// An invalid regex is reported when the options are compiled
+	_, err = compilePathOptions(&types.PathOptions{Rewrites: []types.Rewrite{{Regex: "(", Repl: ""}}})
+	assert.EqualError(t, err, "the rewrite 0 is invalid: could not compile the regex '(': error parsing regexp: missing closing ): `(`")
 }
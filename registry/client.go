@@ -0,0 +1,411 @@
+// This package implements the parts of the OCI distribution API
+// required to push images described by an image JSON file to a
+// registry (Client) and to serve them as a read-only registry
+// (Server).
+package registry
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/nlewo/nix2container/nix"
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+	"go.podman.io/image/v5/docker/reference"
+)
+
+// DefaultChunkSize is the size of the chunks used to upload blobs.
+const DefaultChunkSize = 16 * 1024 * 1024
+
+// Client pushes images to a registry implementing the OCI distribution
+// API.
+type Client struct {
+	// ChunkSize is the size of the chunks used to upload blobs.
+	ChunkSize int64
+	// PlainHTTP makes the client use HTTP instead of HTTPS.
+	PlainHTTP bool
+	Username  string
+	Password  string
+
+	httpClient    *http.Client
+	authorization string
+}
+
+// NewClient creates a Client. If tlsVerify is false, the registry
+// certificate is not verified.
+func NewClient(tlsVerify bool) *Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if !tlsVerify {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true} // nolint: gosec
+	}
+	return &Client{
+		ChunkSize:  DefaultChunkSize,
+		httpClient: &http.Client{Transport: transport},
+	}
+}
+
+// repository is a repository of a registry.
+type repository struct {
+	base *url.URL
+	name string
+}
+
+func (r repository) url(format string, a ...any) string {
+	return r.base.String() + "/v2/" + r.name + fmt.Sprintf(format, a...)
+}
+
+// parseReference returns the repository and the tag of an image
+// reference such as localhost:5000/hello:latest.
+func (c *Client) parseReference(ref string) (repository, string, error) {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return repository{}, "", fmt.Errorf("invalid image reference '%s': %w", ref, err)
+	}
+	tagged, ok := reference.TagNameOnly(named).(reference.NamedTagged)
+	if !ok {
+		return repository{}, "", fmt.Errorf("invalid image reference '%s': a tag is expected", ref)
+	}
+	host := reference.Domain(named)
+	if host == "docker.io" {
+		host = "registry-1.docker.io"
+	}
+	scheme := "https"
+	if c.PlainHTTP {
+		scheme = "http"
+	}
+	return repository{
+		base: &url.URL{Scheme: scheme, Host: host},
+		name: reference.Path(named),
+	}, tagged.Tag(), nil
+}
+
+// Push pushes an image to the registry, at the reference ref such as
+// localhost:5000/hello:latest. Blobs already present in the registry
+// are skipped and the manifest is pushed once all blobs have been
+// uploaded.
+func (c *Client) Push(image types.Image, ref string) error {
+	repo, tag, err := c.parseReference(ref)
+	if err != nil {
+		return err
+	}
+	if err := c.authenticate(repo); err != nil {
+		return err
+	}
+	if err := c.pushBlobs(repo, image); err != nil {
+		return err
+	}
+	manifestBlob, err := nix.GetManifest(image)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("Uploading manifest %s to %s:%s", godigest.FromBytes(manifestBlob), repo.name, tag)
+	return c.putManifest(repo, tag, v1.MediaTypeImageManifest, manifestBlob)
+}
+
+// PushIndex pushes a multi-architecture image to the registry, at the
+// reference ref. The manifest of each image is pushed by digest and
+// the image index is then pushed with the tag of ref.
+func (c *Client) PushIndex(index types.ImageIndex, ref string) error {
+	repo, tag, err := c.parseReference(ref)
+	if err != nil {
+		return err
+	}
+	if err := c.authenticate(repo); err != nil {
+		return err
+	}
+	for _, image := range index.Images {
+		if err := c.pushBlobs(repo, image); err != nil {
+			return err
+		}
+		manifestBlob, err := nix.GetManifest(image)
+		if err != nil {
+			return err
+		}
+		manifestDigest := godigest.FromBytes(manifestBlob)
+		logrus.Infof("Uploading manifest %s to %s", manifestDigest, repo.name)
+		if err := c.putManifest(repo, manifestDigest.String(), v1.MediaTypeImageManifest, manifestBlob); err != nil {
+			return err
+		}
+	}
+	indexBlob, err := nix.GetIndexManifest(index)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("Uploading image index %s to %s:%s", godigest.FromBytes(indexBlob), repo.name, tag)
+	return c.putManifest(repo, tag, v1.MediaTypeImageIndex, indexBlob)
+}
+
+// pushBlobs uploads the config and the layers of an image which are
+// not already present in the registry.
+func (c *Client) pushBlobs(repo repository, image types.Image) error {
+	configDigest, _, err := nix.GetConfigDigest(image)
+	if err != nil {
+		return err
+	}
+	digests := []godigest.Digest{configDigest}
+	for _, layer := range image.Layers {
+		d, err := godigest.Parse(layer.Digest)
+		if err != nil {
+			return err
+		}
+		digests = append(digests, d)
+	}
+
+	pushed := make(map[godigest.Digest]bool)
+	for _, d := range digests {
+		if pushed[d] {
+			continue
+		}
+		pushed[d] = true
+		exists, err := c.blobExists(repo, d)
+		if err != nil {
+			return err
+		}
+		if exists {
+			logrus.Infof("Skipping blob %s: already present in %s", d, repo.name)
+			continue
+		}
+		logrus.Infof("Uploading blob %s to %s", d, repo.name)
+		reader, _, err := nix.GetBlob(image, d)
+		if err != nil {
+			return err
+		}
+		err = c.uploadBlob(repo, d, reader)
+		reader.Close() // nolint: errcheck
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) do(method, u string, body []byte, headers map[string]string) (*http.Response, error) {
+	req, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	if c.authorization != "" {
+		req.Header.Set("Authorization", c.authorization)
+	}
+	return c.httpClient.Do(req)
+}
+
+// responseError returns an error describing an unexpected response
+// of the registry.
+func responseError(method, u string, resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return fmt.Errorf("%s %s: unexpected status '%s': %s", method, u, resp.Status, strings.TrimSpace(string(body)))
+}
+
+func (c *Client) blobExists(repo repository, d godigest.Digest) (bool, error) {
+	u := repo.url("/blobs/%s", d)
+	resp, err := c.do(http.MethodHead, u, nil, nil)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, responseError(http.MethodHead, u, resp)
+	}
+}
+
+// uploadBlob uploads the content of reader in chunks of ChunkSize
+// bytes. The upload is completed by a PUT request carrying the blob
+// digest, which is then checked by the registry.
+func (c *Client) uploadBlob(repo repository, d godigest.Digest, reader io.Reader) error {
+	u := repo.url("/blobs/uploads/")
+	resp, err := c.do(http.MethodPost, u, nil, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusAccepted {
+		defer resp.Body.Close() // nolint: errcheck
+		return responseError(http.MethodPost, u, resp)
+	}
+	resp.Body.Close() // nolint: errcheck
+	location, err := uploadLocation(resp)
+	if err != nil {
+		return err
+	}
+
+	chunkSize := c.ChunkSize
+	if minLength, err := strconv.ParseInt(resp.Header.Get("OCI-Chunk-Min-Length"), 10, 64); err == nil && minLength > chunkSize {
+		chunkSize = minLength
+	}
+	chunk := make([]byte, chunkSize)
+	var offset int64
+	for {
+		n, err := io.ReadFull(reader, chunk)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		headers := map[string]string{
+			"Content-Type":  "application/octet-stream",
+			"Content-Range": fmt.Sprintf("%d-%d", offset, offset+int64(n)-1),
+		}
+		resp, err := c.do(http.MethodPatch, location.String(), chunk[:n], headers)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusAccepted {
+			defer resp.Body.Close() // nolint: errcheck
+			return responseError(http.MethodPatch, location.String(), resp)
+		}
+		resp.Body.Close() // nolint: errcheck
+		if location, err = uploadLocation(resp); err != nil {
+			return err
+		}
+		offset += int64(n)
+	}
+
+	query := location.Query()
+	query.Set("digest", d.String())
+	location.RawQuery = query.Encode()
+	resp, err = c.do(http.MethodPut, location.String(), nil, map[string]string{"Content-Type": "application/octet-stream"})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+	if resp.StatusCode != http.StatusCreated {
+		return responseError(http.MethodPut, location.String(), resp)
+	}
+	return nil
+}
+
+// uploadLocation returns the URL of the upload session from the
+// Location header, which can be relative to the request URL.
+func uploadLocation(resp *http.Response) (*url.URL, error) {
+	location, err := resp.Location()
+	if err != nil {
+		return nil, fmt.Errorf("the registry didn't return an upload location: %w", err)
+	}
+	return location, nil
+}
+
+func (c *Client) putManifest(repo repository, ref, mediaType string, manifest []byte) error {
+	u := repo.url("/manifests/%s", ref)
+	resp, err := c.do(http.MethodPut, u, manifest, map[string]string{"Content-Type": mediaType})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+	if resp.StatusCode != http.StatusCreated {
+		return responseError(http.MethodPut, u, resp)
+	}
+	return nil
+}
+
+// authenticate checks if the registry requires an authentication. If
+// it does, a Basic authorization is used when it is requested by the
+// registry, otherwise a Bearer token allowing to push to the
+// repository is requested to the token server.
+func (c *Client) authenticate(repo repository) error {
+	u := repo.base.String() + "/v2/"
+	resp, err := c.do(http.MethodGet, u, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close() // nolint: errcheck
+	if resp.StatusCode != http.StatusUnauthorized {
+		return nil
+	}
+	scheme, params := parseChallenge(resp.Header.Get("WWW-Authenticate"))
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if c.Username == "" {
+			return fmt.Errorf("the registry %s requires credentials", repo.base.Host)
+		}
+		req, _ := http.NewRequest(http.MethodGet, u, nil)
+		req.SetBasicAuth(c.Username, c.Password)
+		c.authorization = req.Header.Get("Authorization")
+		return nil
+	case "bearer":
+		return c.requestToken(repo, params)
+	default:
+		return fmt.Errorf("unsupported authentication challenge '%s' from the registry %s", resp.Header.Get("WWW-Authenticate"), repo.base.Host)
+	}
+}
+
+func (c *Client) requestToken(repo repository, params map[string]string) error {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return fmt.Errorf("invalid token realm '%s'", params["realm"])
+	}
+	query := realm.Query()
+	if service, ok := params["service"]; ok {
+		query.Set("service", service)
+	}
+	query.Set("scope", fmt.Sprintf("repository:%s:pull,push", repo.name))
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return err
+	}
+	if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+	if resp.StatusCode != http.StatusOK {
+		return responseError(http.MethodGet, realm.String(), resp)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return err
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	if token.Token == "" {
+		return fmt.Errorf("the token server %s didn't return a token", realm.Host)
+	}
+	c.authorization = "Bearer " + token.Token
+	return nil
+}
+
+// parseChallenge parses a WWW-Authenticate header such as
+// `Bearer realm="https://auth.docker.io/token",service="registry.docker.io"`.
+func parseChallenge(header string) (scheme string, params map[string]string) {
+	params = make(map[string]string)
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	for rest != "" {
+		var key, value string
+		key, rest, _ = strings.Cut(strings.TrimLeft(rest, " ,"), "=")
+		if strings.HasPrefix(rest, `"`) {
+			value, rest, _ = strings.Cut(rest[1:], `"`)
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		if key != "" {
+			params[strings.ToLower(strings.TrimSpace(key))] = value
+		}
+	}
+	return scheme, params
+}
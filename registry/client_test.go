@@ -0,0 +1,192 @@
+package registry
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nlewo/nix2container/nix"
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeRegistry is a minimal in-memory implementation of the push
+// endpoints of the OCI distribution API.
+type fakeRegistry struct {
+	mu        sync.Mutex
+	token     string
+	blobs     map[string][]byte
+	uploads   map[string][]byte
+	manifests map[string][]byte
+	patches   int
+}
+
+func newFakeRegistry() *fakeRegistry {
+	return &fakeRegistry{
+		blobs:     make(map[string][]byte),
+		uploads:   make(map[string][]byte),
+		manifests: make(map[string][]byte),
+	}
+}
+
+func (f *fakeRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.URL.Path == "/token" {
+		fmt.Fprintf(w, `{"token": "%s"}`, f.token)
+		return
+	}
+	if f.token != "" && r.Header.Get("Authorization") != "Bearer "+f.token {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token",service="fake"`, r.Host))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	path := r.URL.Path
+	switch {
+	case path == "/v2/":
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodHead && strings.Contains(path, "/blobs/"):
+		digest := path[strings.LastIndex(path, "/")+1:]
+		if _, ok := f.blobs[digest]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	case r.Method == http.MethodPost && strings.HasSuffix(path, "/blobs/uploads/"):
+		id := fmt.Sprintf("%d", len(f.uploads))
+		f.uploads[id] = []byte{}
+		w.Header().Set("Location", path+id)
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == http.MethodPatch && strings.Contains(path, "/blobs/uploads/"):
+		id := path[strings.LastIndex(path, "/")+1:]
+		content, _ := io.ReadAll(r.Body)
+		expectedRange := fmt.Sprintf("%d-%d", len(f.uploads[id]), len(f.uploads[id])+len(content)-1)
+		if r.Header.Get("Content-Range") != expectedRange {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		f.uploads[id] = append(f.uploads[id], content...)
+		f.patches++
+		w.Header().Set("Location", path)
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == http.MethodPut && strings.Contains(path, "/blobs/uploads/"):
+		id := path[strings.LastIndex(path, "/")+1:]
+		digest := r.URL.Query().Get("digest")
+		if godigest.FromBytes(f.uploads[id]).String() != digest {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.blobs[digest] = f.uploads[id]
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == http.MethodPut && strings.Contains(path, "/manifests/"):
+		content, _ := io.ReadAll(r.Body)
+		f.manifests[path] = content
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func testImage(t *testing.T) types.Image {
+	paths := []string{
+		"../data/layer1/file1",
+	}
+	layers, _, err := nix.NewLayers(paths, nix.LayerOptions{})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return types.Image{
+		Version: types.ImageVersion,
+		Arch:    "amd64",
+		Layers:  layers,
+	}
+}
+
+func TestPush(t *testing.T) {
+	image := testImage(t)
+	registry := newFakeRegistry()
+	server := httptest.NewServer(registry)
+	defer server.Close()
+
+	client := NewClient(true)
+	client.PlainHTTP = true
+	client.ChunkSize = 1000
+	ref := strings.TrimPrefix(server.URL, "http://") + "/hello:latest"
+	err := client.Push(image, ref)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	configDigest, _, err := nix.GetConfigDigest(image)
+	assert.Nil(t, err)
+	assert.Contains(t, registry.blobs, configDigest.String())
+	assert.Contains(t, registry.blobs, image.Layers[0].Digest)
+	manifest, err := nix.GetManifest(image)
+	assert.Nil(t, err)
+	assert.Equal(t, manifest, registry.manifests["/v2/hello/manifests/latest"])
+	// The layer is 3072 bytes long and is uploaded in 4 chunks,
+	// while the config fits in a single chunk.
+	assert.Equal(t, 5, registry.patches)
+
+	// Blobs already present in the registry are not uploaded again
+	registry.patches = 0
+	err = client.Push(image, ref)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, registry.patches)
+}
+
+func TestPushIndex(t *testing.T) {
+	image := testImage(t)
+	arm64 := testImage(t)
+	arm64.Arch = "arm64"
+	index, err := nix.NewImageIndex([]types.Image{image, arm64})
+	assert.Nil(t, err)
+	registry := newFakeRegistry()
+	server := httptest.NewServer(registry)
+	defer server.Close()
+
+	client := NewClient(true)
+	client.PlainHTTP = true
+	err = client.PushIndex(index, strings.TrimPrefix(server.URL, "http://")+"/hello:latest")
+	assert.Nil(t, err)
+
+	indexBlob, err := nix.GetIndexManifest(index)
+	assert.Nil(t, err)
+	assert.Equal(t, indexBlob, registry.manifests["/v2/hello/manifests/latest"])
+	for _, i := range index.Images {
+		manifest, err := nix.GetManifest(i)
+		assert.Nil(t, err)
+		assert.Equal(t, manifest, registry.manifests["/v2/hello/manifests/"+godigest.FromBytes(manifest).String()])
+	}
+}
+
+func TestPushWithToken(t *testing.T) {
+	image := testImage(t)
+	registry := newFakeRegistry()
+	registry.token = "secret"
+	server := httptest.NewServer(registry)
+	defer server.Close()
+
+	client := NewClient(true)
+	client.PlainHTTP = true
+	err := client.Push(image, strings.TrimPrefix(server.URL, "http://")+"/hello:latest")
+	assert.Nil(t, err)
+	assert.Contains(t, registry.manifests, "/v2/hello/manifests/latest")
+}
+
+func TestParseChallenge(t *testing.T) {
+	scheme, params := parseChallenge(`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/hello:pull,push"`)
+	assert.Equal(t, "Bearer", scheme)
+	assert.Equal(t, map[string]string{
+		"realm":   "https://auth.docker.io/token",
+		"service": "registry.docker.io",
+		"scope":   "repository:library/hello:pull,push",
+	}, params)
+}
@@ -0,0 +1,205 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nlewo/nix2container/nix"
+	"github.com/nlewo/nix2container/types"
+	godigest "github.com/opencontainers/go-digest"
+	v1 "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+)
+
+// servedImage is an image served by the Server, with its manifest
+// and the size of its blobs precomputed to answer HEAD requests
+// without having to build the layer tarballs.
+type servedImage struct {
+	image          types.Image
+	manifest       []byte
+	manifestDigest godigest.Digest
+	blobSizes      map[godigest.Digest]int64
+}
+
+// Server is a read-only registry serving images described by image
+// JSON files over the pull endpoints of the OCI distribution API.
+// Layer tarballs are built on demand from the Nix store.
+type Server struct {
+	// repository name -> tag -> image
+	repositories map[string]map[string]*servedImage
+}
+
+// NewServer creates a Server without any image.
+func NewServer() *Server {
+	return &Server{
+		repositories: make(map[string]map[string]*servedImage),
+	}
+}
+
+// AddImage serves image as name:tag.
+func (s *Server) AddImage(name, tag string, image types.Image) error {
+	manifestBlob, err := nix.GetManifest(image)
+	if err != nil {
+		return err
+	}
+	var manifest v1.Manifest
+	if err := json.Unmarshal(manifestBlob, &manifest); err != nil {
+		return err
+	}
+	served := &servedImage{
+		image:          image,
+		manifest:       manifestBlob,
+		manifestDigest: godigest.FromBytes(manifestBlob),
+		blobSizes:      map[godigest.Digest]int64{manifest.Config.Digest: manifest.Config.Size},
+	}
+	for _, layer := range manifest.Layers {
+		served.blobSizes[layer.Digest] = layer.Size
+	}
+	if _, ok := s.repositories[name]; !ok {
+		s.repositories[name] = make(map[string]*servedImage)
+	}
+	s.repositories[name][tag] = served
+	logrus.Infof("Serving image %s:%s (%s)", name, tag, served.manifestDigest)
+	return nil
+}
+
+// registryError writes an error as described by the OCI distribution
+// specification.
+func registryError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	body, _ := json.Marshal(map[string]any{
+		"errors": []map[string]string{{"code": code, "message": message}},
+	})
+	w.Write(body) // nolint: errcheck
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logrus.Debugf("%s %s", r.Method, r.URL.Path)
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		registryError(w, http.StatusMethodNotAllowed, "UNSUPPORTED", "this registry is read-only")
+		return
+	}
+	path, ok := strings.CutPrefix(r.URL.Path, "/v2/")
+	if !ok {
+		registryError(w, http.StatusNotFound, "NOT_FOUND", "not found")
+		return
+	}
+	if path == "" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if name, ok := strings.CutSuffix(path, "/tags/list"); ok {
+		s.serveTags(w, r, name)
+		return
+	}
+	if i := strings.LastIndex(path, "/manifests/"); i != -1 {
+		s.serveManifest(w, r, path[:i], path[i+len("/manifests/"):])
+		return
+	}
+	if i := strings.LastIndex(path, "/blobs/"); i != -1 {
+		s.serveBlob(w, r, path[:i], path[i+len("/blobs/"):])
+		return
+	}
+	registryError(w, http.StatusNotFound, "NOT_FOUND", "not found")
+}
+
+func (s *Server) serveTags(w http.ResponseWriter, r *http.Request, name string) {
+	repository, ok := s.repositories[name]
+	if !ok {
+		registryError(w, http.StatusNotFound, "NAME_UNKNOWN", fmt.Sprintf("repository %s is not known", name))
+		return
+	}
+	tags := make([]string, 0, len(repository))
+	last := r.URL.Query().Get("last")
+	for tag := range repository {
+		if tag > last {
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	if n, err := strconv.Atoi(r.URL.Query().Get("n")); err == nil && n >= 0 && n < len(tags) {
+		tags = tags[:n]
+	}
+	body, err := json.Marshal(map[string]any{"name": name, "tags": tags})
+	if err != nil {
+		registryError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	if r.Method == http.MethodGet {
+		w.Write(body) // nolint: errcheck
+	}
+}
+
+func (s *Server) serveManifest(w http.ResponseWriter, r *http.Request, name, reference string) {
+	repository, ok := s.repositories[name]
+	if !ok {
+		registryError(w, http.StatusNotFound, "NAME_UNKNOWN", fmt.Sprintf("repository %s is not known", name))
+		return
+	}
+	served, ok := repository[reference]
+	if !ok {
+		for _, image := range repository {
+			if image.manifestDigest.String() == reference {
+				served = image
+				break
+			}
+		}
+	}
+	if served == nil {
+		registryError(w, http.StatusNotFound, "MANIFEST_UNKNOWN", fmt.Sprintf("manifest %s is not known", reference))
+		return
+	}
+	w.Header().Set("Content-Type", v1.MediaTypeImageManifest)
+	w.Header().Set("Content-Length", strconv.Itoa(len(served.manifest)))
+	w.Header().Set("Docker-Content-Digest", served.manifestDigest.String())
+	if r.Method == http.MethodGet {
+		w.Write(served.manifest) // nolint: errcheck
+	}
+}
+
+func (s *Server) serveBlob(w http.ResponseWriter, r *http.Request, name, reference string) {
+	repository, ok := s.repositories[name]
+	if !ok {
+		registryError(w, http.StatusNotFound, "NAME_UNKNOWN", fmt.Sprintf("repository %s is not known", name))
+		return
+	}
+	digest, err := godigest.Parse(reference)
+	if err != nil {
+		registryError(w, http.StatusBadRequest, "DIGEST_INVALID", err.Error())
+		return
+	}
+	for _, served := range repository {
+		size, ok := served.blobSizes[digest]
+		if !ok {
+			continue
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		w.Header().Set("Docker-Content-Digest", digest.String())
+		if r.Method == http.MethodHead {
+			return
+		}
+		reader, _, err := nix.GetBlob(served.image, digest)
+		if err != nil {
+			registryError(w, http.StatusInternalServerError, "UNKNOWN", err.Error())
+			return
+		}
+		defer reader.Close() // nolint: errcheck
+		if _, err := io.Copy(w, reader); err != nil {
+			// The status has already been sent: the client
+			// gets a truncated blob it will reject.
+			logrus.Errorf("Failed to send the blob %s: %s", digest, err)
+		}
+		return
+	}
+	registryError(w, http.StatusNotFound, "BLOB_UNKNOWN", fmt.Sprintf("blob %s is not known", digest))
+}
@@ -0,0 +1,85 @@
+package registry
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/nlewo/nix2container/nix"
+	godigest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServer(t *testing.T) {
+	image := testImage(t)
+	server := NewServer()
+	assert.Nil(t, server.AddImage("library/hello", "latest", image))
+	assert.Nil(t, server.AddImage("library/hello", "1.0", image))
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	get := func(method, path string) (*http.Response, []byte) {
+		req, err := http.NewRequest(method, ts.URL+path, nil)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		defer resp.Body.Close() // nolint: errcheck
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		return resp, body
+	}
+
+	resp, _ := get(http.MethodGet, "/v2/")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	manifest, err := nix.GetManifest(image)
+	assert.Nil(t, err)
+	manifestDigest := godigest.FromBytes(manifest).String()
+	resp, body := get(http.MethodGet, "/v2/library/hello/manifests/latest")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, manifest, body)
+	assert.Equal(t, manifestDigest, resp.Header.Get("Docker-Content-Digest"))
+	resp, body = get(http.MethodGet, "/v2/library/hello/manifests/"+manifestDigest)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, manifest, body)
+	resp, _ = get(http.MethodGet, "/v2/library/hello/manifests/unknown")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	layer := image.Layers[0]
+	resp, body = get(http.MethodHead, "/v2/library/hello/blobs/"+layer.Digest)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, strconv.FormatInt(layer.Size, 10), resp.Header.Get("Content-Length"))
+	assert.Empty(t, body)
+	resp, body = get(http.MethodGet, "/v2/library/hello/blobs/"+layer.Digest)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, layer.Digest, godigest.FromBytes(body).String())
+	configDigest, _, err := nix.GetConfigDigest(image)
+	assert.Nil(t, err)
+	resp, body = get(http.MethodGet, "/v2/library/hello/blobs/"+configDigest.String())
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, configDigest, godigest.FromBytes(body))
+	resp, _ = get(http.MethodGet, "/v2/library/other/blobs/"+layer.Digest)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, body = get(http.MethodGet, "/v2/library/hello/tags/list")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var tags struct {
+		Name string   `json:"name"`
+		Tags []string `json:"tags"`
+	}
+	assert.Nil(t, json.Unmarshal(body, &tags))
+	assert.Equal(t, "library/hello", tags.Name)
+	assert.Equal(t, []string{"1.0", "latest"}, tags.Tags)
+
+	resp, _ = get(http.MethodDelete, "/v2/library/hello/manifests/latest")
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
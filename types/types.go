@@ -2,6 +2,7 @@ package types
 
 import (
 	"encoding/json"
+	"fmt"
 	"io"
 	"os"
 	"time"
@@ -19,7 +20,20 @@ type Image struct {
 	ImageConfig v1.ImageConfig `json:"image-config"`
 	Layers      []Layer        `json:"layers"`
 	Arch        string         `json:"arch"`
-	Created     *time.Time     `json:"created"`
+	// CPU variant, such as v7 for the arm architecture
+	Variant    string     `json:"variant,omitempty"`
+	OSVersion  string     `json:"os-version,omitempty"`
+	OSFeatures []string   `json:"os-features,omitempty"`
+	Created    *time.Time `json:"created"`
+}
+
+// ImageIndex represents the JSON file describing a
+// multi-architecture image produced by nix2container. It contains
+// one Image per platform and is exported or pushed as an OCI image
+// index.
+type ImageIndex struct {
+	Version int     `json:"version"`
+	Images  []Image `json:"images"`
 }
 
 type Rewrite struct {
@@ -39,35 +53,122 @@ type RewritePath struct {
 	Repl  string `json:"repl"`
 }
 
+// LayerGroup describes a named layer containing all store paths
+// matching Regex. The Name is recorded in the history comment of the
+// layer.
+type LayerGroup struct {
+	Name  string `json:"name"`
+	Regex string `json:"regex"`
+}
+
+// LayerPlan maps the name of store paths, without their hash, to the
+// slot of the layer containing them. It is written by a build and
+// read by the next one to keep store paths in the same layers.
+type LayerPlan map[string]int
+
 type Perm struct {
 	Regex string `json:"regex"`
-	// Octal representation of file permissions
+	// Octal representation of file permissions or chmod symbolic
+	// expressions, such as g+w,u+s, applied to the file mode
 	Mode  string `json:"mode"`
 	Uid   int    `json:"uid"`
 	Gid   int    `json:"gid"`
 	Uname string `json:"uname"`
 	Gname string `json:"gname"`
+	// Extended attributes, such as security.capability whose
+	// value is given in the textual form cap_net_bind_service=+ep
+	Xattrs map[string]string `json:"xattrs,omitempty"`
+	// The path matched by Regex: "source", the path in the Nix
+	// store (default), or "destination", the path in the layer
+	Match string `json:"match,omitempty"`
+	// Restricts the perm to a kind of files: file, dir, symlink or
+	// executable
+	Type string `json:"type,omitempty"`
 }
 
 type PermPath struct {
 	Path  string `json:"path"`
 	Regex string `json:"regex"`
-	// Octal representation of file permissions
+	// Octal representation of file permissions or chmod symbolic
+	// expressions, such as g+w,u+s, applied to the file mode
 	Mode  string `json:"mode"`
 	Uid   int    `json:"uid"`
 	Gid   int    `json:"gid"`
 	Uname string `json:"uname"`
 	Gname string `json:"gname"`
+	// Extended attributes (see Perm)
+	Xattrs map[string]string `json:"xattrs,omitempty"`
+	// See Perm
+	Match string `json:"match,omitempty"`
+	Type  string `json:"type,omitempty"`
+}
+
+// Entry describes a file, a directory, a symlink or a device node
+// which doesn't exist in the Nix store but is created in a layer.
+type Entry struct {
+	// One of file, directory, symlink, char-device or block-device
+	Type string `json:"type"`
+	Path string `json:"path"`
+	// Content of a file
+	Content string `json:"content,omitempty"`
+	// Target of a symlink
+	Target string `json:"target,omitempty"`
+	// Octal representation of file permissions
+	Mode  string `json:"mode,omitempty"`
+	Uid   int    `json:"uid,omitempty"`
+	Gid   int    `json:"gid,omitempty"`
+	Uname string `json:"uname,omitempty"`
+	Gname string `json:"gname,omitempty"`
+	// Major and minor numbers of a device node
+	Major int64 `json:"major,omitempty"`
+	Minor int64 `json:"minor,omitempty"`
+}
+
+// Deletion describes a file or a directory of the lower layers, such
+// as the layers of a base image, which is deleted by a layer.
+type Deletion struct {
+	Path string `json:"path"`
+	// If true, the directory Path is kept but its content coming
+	// from the lower layers is hidden (opaque directory)
+	Opaque bool `json:"opaque,omitempty"`
 }
 
 type PathOptions struct {
-	Rewrite Rewrite `json:"rewrite,omitempty"`
-	Perms   []Perm  `json:"perms,omitempty"`
+	// Rewrites applied in order to the paths of the files
+	Rewrites []Rewrite `json:"rewrites,omitempty"`
+	Perms    []Perm    `json:"perms,omitempty"`
+}
+
+// UnmarshalJSON also accepts the single rewrite of the files written
+// by older versions of nix2container, whose field is "rewrite". This
+// rewrite is ignored if its regex is empty.
+func (o *PathOptions) UnmarshalJSON(data []byte) error {
+	type pathOptions PathOptions
+	var options struct {
+		pathOptions
+		Rewrite *Rewrite `json:"rewrite"`
+	}
+	if err := json.Unmarshal(data, &options); err != nil {
+		return err
+	}
+	*o = PathOptions(options.pathOptions)
+	if options.Rewrite != nil && options.Rewrite.Regex != "" {
+		if len(o.Rewrites) > 0 {
+			return fmt.Errorf("the options contain both the rewrite and the rewrites fields")
+		}
+		o.Rewrites = []Rewrite{*options.Rewrite}
+	}
+	return nil
 }
 
 type Path struct {
 	Path    string       `json:"path"`
 	Options *PathOptions `json:"options,omitempty"`
+	// The store path this path belongs to, when the layer of this
+	// store path has been split in several layers
+	SplitFrom string `json:"split-from,omitempty"`
+	// If true, the directory Path is added without its files
+	DirectoryOnly bool `json:"directory-only,omitempty"`
 }
 
 type Paths []Path
@@ -77,6 +178,20 @@ type Layer struct {
 	Size    int64  `json:"size"`
 	DiffIDs string `json:"diff_ids"`
 	Paths   Paths  `json:"paths,omitempty"`
+	// Files which are not in the Nix store created by this layer
+	Entries []Entry `json:"entries,omitempty"`
+	// Files of lower layers deleted by this layer
+	Deletions []Deletion `json:"deletions,omitempty"`
+	// Perms of the directories which are not in the Nix store,
+	// such as /nix/store, whose regex is matched against their
+	// path in the layer
+	DirectoryPerms []Perm `json:"directory-perms,omitempty"`
+	// If true, files sharing their inode are written as hard links
+	HardLinks bool `json:"hard-links,omitempty"`
+	// The sum of the popularity, in the closure graph, of the store
+	// paths of this layer. The least popular layers are merged when
+	// an image has too many layers.
+	Popularity int64 `json:"popularity,omitempty"`
 	// OCI mediatype
 	// https://github.com/opencontainers/image-spec/blob/8b9d41f48198a7d6d0a5c1a12dc2d1f7f47fc97f/specs-go/v1/mediatype.go
 	MediaType string `json:"mediatype"`